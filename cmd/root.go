@@ -42,7 +42,12 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file path (default is config.yaml)")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "")
+	rootCmd.AddCommand(cloneCmd)
+	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(generateDefaultConfigurationCmd)
+	rootCmd.AddCommand(listReposCmd)
 	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(validateConfigCmd)
 	rootCmd.AddCommand(versionCmd)
 }
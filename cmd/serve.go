@@ -23,11 +23,18 @@ import (
 
 var cfgFile string
 var debug bool
+var serveListen string
+var serveUnixSocket string
 
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start the smithy server",
 	Run: func(cmd *cobra.Command, args []string) {
-		smithy.StartServer(cfgFile, debug)
+		smithy.StartServer(cfgFile, debug, serveListen, serveUnixSocket)
 	},
 }
+
+func init() {
+	serveCmd.Flags().StringVar(&serveListen, "listen", "", "address to bind to, overrides listen_address")
+	serveCmd.Flags().StringVar(&serveUnixSocket, "unix-socket", "", "Unix domain socket to listen on, overrides unix_socket")
+}
@@ -0,0 +1,65 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/honza/smithy/pkg/smithy"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var validateConfigOutput string
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "Load the configuration and print the effective result",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := smithy.LoadConfig(cfgFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		resolved := config.Resolved()
+
+		var out []byte
+		switch validateConfigOutput {
+		case "yaml":
+			out, err = yaml.Marshal(resolved)
+		case "json":
+			out, err = json.MarshalIndent(resolved, "", "  ")
+			out = append(out, '\n')
+		default:
+			err = fmt.Errorf("unknown output format %q", validateConfigOutput)
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Print(string(out))
+	},
+}
+
+func init() {
+	validateConfigCmd.Flags().StringVar(&validateConfigOutput, "output", "yaml", "output format, yaml or json")
+}
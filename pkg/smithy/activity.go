@@ -0,0 +1,255 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Periods commits can be grouped by, and how many of each are returned
+const (
+	ActivityPeriodWeek  = "week"
+	ActivityPeriodMonth = "month"
+
+	ActivityWeeks  = 52
+	ActivityMonths = 12
+)
+
+// Activity is the number of commits in each of the last weeks or months,
+// oldest first
+type Activity struct {
+	Labels []string `json:"labels"`
+	Counts []int    `json:"counts"`
+}
+
+// activityKey identifies a cached Activity.  The latest period is part of
+// the key so that entries don't outlive the week or month they were
+// computed in.
+type activityKey struct {
+	hash   plumbing.Hash
+	period string
+	latest string
+}
+
+// activitySlot is where the Activity of a repository directory for a period
+// is cached
+type activitySlot struct {
+	path   string
+	period string
+}
+
+// cachedActivity is an Activity along with the key it was counted for
+type cachedActivity struct {
+	key      activityKey
+	activity Activity
+}
+
+var (
+	// activityCache only holds the last Activity of each slot, so that it
+	// doesn't grow as HEAD moves.  Repositories that aren't stored on disk
+	// aren't cached.
+	activityCache      = map[activitySlot]cachedActivity{}
+	activityCacheMutex sync.Mutex
+)
+
+// activityLabel names the week or month t falls in, e.g. 2024-W01 or
+// 2024-01
+func activityLabel(t time.Time, period string) string {
+	if period == ActivityPeriodMonth {
+		return t.Format("2006-01")
+	}
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// activityStart returns when the oldest of the periods ending with the one
+// now falls in begins, and the label of each period
+func activityStart(now time.Time, period string) (time.Time, []string) {
+	var labels []string
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	if period == ActivityPeriodMonth {
+		start := time.Date(now.Year(), now.Month()-ActivityMonths+1, 1, 0, 0, 0, 0, now.Location())
+		for i := 0; i < ActivityMonths; i++ {
+			labels = append(labels, activityLabel(start.AddDate(0, i, 0), period))
+		}
+		return start, labels
+	}
+
+	// ISO weeks start on Monday
+	monday := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	start := monday.AddDate(0, 0, -7*(ActivityWeeks-1))
+	for i := 0; i < ActivityWeeks; i++ {
+		labels = append(labels, activityLabel(start.AddDate(0, 0, 7*i), period))
+	}
+	return start, labels
+}
+
+// ComputeActivity counts the commits reachable from commit in each of the
+// last weeks or months before now, giving up once ctx is done
+func ComputeActivity(ctx context.Context, r *git.Repository, commit *object.Commit, period string, now time.Time) (Activity, error) {
+	start, labels := activityStart(now, period)
+	key := activityKey{hash: commit.Hash, period: period, latest: labels[len(labels)-1]}
+	slot := activitySlot{path: repositoryPath(r), period: period}
+
+	activityCacheMutex.Lock()
+	cached, ok := activityCache[slot]
+	activityCacheMutex.Unlock()
+	if ok && cached.key == key {
+		return cached.activity, nil
+	}
+
+	flightKey := fmt.Sprintf("activity:%s:%s:%s:%s", slot.path, key.hash, key.period, key.latest)
+	return shareGitOperation(ctx, flightKey, func(ctx context.Context) (Activity, error) {
+		activity, err := countActivity(ctx, r, commit, key, start, labels, now.Location())
+		if err != nil || slot.path == "" {
+			return activity, err
+		}
+
+		activityCacheMutex.Lock()
+		activityCache[slot] = cachedActivity{key: key, activity: activity}
+		activityCacheMutex.Unlock()
+
+		return activity, nil
+	})
+}
+
+// countActivity counts the commits reachable from commit in each of the
+// periods named by labels, the first of which begins at start
+func countActivity(ctx context.Context, r *git.Repository, commit *object.Commit, key activityKey, start time.Time, labels []string, loc *time.Location) (Activity, error) {
+	period := key.period
+
+	indexes := map[string]int{}
+	for i, label := range labels {
+		indexes[label] = i
+	}
+	counts := make([]int, len(labels))
+
+	missing, err := missingParents(r)
+	if err != nil {
+		return Activity{}, err
+	}
+
+	cIter := object.NewCommitIterCTime(commit, missing, nil)
+	defer cIter.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return Activity{}, err
+		}
+
+		c, err := cIter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Activity{}, err
+		}
+
+		// Commits come newest first, the rest are too old to count
+		when := c.Committer.When.In(loc)
+		if when.Before(start) {
+			break
+		}
+
+		if i, ok := indexes[activityLabel(when, period)]; ok {
+			counts[i]++
+		}
+	}
+
+	return Activity{Labels: labels, Counts: counts}, nil
+}
+
+type activityParams struct {
+	Ref    string `query:"ref"`
+	Period string `query:"period"`
+}
+
+// ActivityView returns the number of commits per week or month as JSON, for
+// drawing activity charts
+func ActivityView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	params, err := ParseQueryParams(ctx, activityParams{Period: ActivityPeriodWeek})
+	if err != nil {
+		return
+	}
+
+	if params.Period != ActivityPeriodWeek && params.Period != ActivityPeriodMonth {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("period must be %s or %s", ActivityPeriodWeek, ActivityPeriodMonth),
+		})
+		return
+	}
+
+	if params.Ref == "" {
+		params.Ref, _, err = findDefaultBranch(smithyConfig, repo)
+		if err != nil {
+			Http404(ctx)
+			return
+		}
+	}
+
+	r := repo.Repository
+	revision, err := r.ResolveRevision(plumbing.Revision(params.Ref))
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", params.Ref, repoName))
+		return
+	}
+
+	commit, err := r.CommitObject(*revision)
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	var activity Activity
+
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		activity, err = ComputeActivity(ctx, r, commit, params.Period, time.Now())
+		return err
+	})
+	ObserveGitOperation(GitOperationLog, repoName, time.Since(start))
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, activity)
+}
@@ -0,0 +1,600 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// APIv1Prefix is prepended to any page's path to get its JSON representation
+const APIv1Prefix = "/api/v1"
+
+// Types making up version 1 of the JSON API.  Fields may be added, but
+// existing ones must keep their name and meaning.
+
+type APIRepo struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Language    string `json:"language"`
+	CloneURL    string `json:"clone_url,omitempty"`
+	SSHCloneURL string `json:"ssh_clone_url,omitempty"`
+	ForkedFrom  string `json:"forked_from,omitempty"`
+	MirrorOf    string `json:"mirror_of,omitempty"`
+}
+
+type APIIndex struct {
+	Repos     []APIRepo `json:"repos"`
+	Page      int       `json:"page"`
+	PerPage   int       `json:"per_page"`
+	PageCount int       `json:"page_count"`
+}
+
+type APIRef struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+type APIRepoIndex struct {
+	APIRepo
+	Branches    []APIRef `json:"branches"`
+	BranchCount int      `json:"branch_count"`
+	Tags        []APIRef `json:"tags"`
+	TagCount    int      `json:"tag_count"`
+	Readme      string   `json:"readme"`
+
+	// Names of the license, changelog and contributors files at the root of
+	// the default branch, if any
+	License      string `json:"license,omitempty"`
+	Changelog    string `json:"changelog,omitempty"`
+	Contributors string `json:"contributors,omitempty"`
+
+	// LatestRelease is found in commit subjects with the repository's
+	// version_pattern
+	LatestRelease string `json:"latest_release,omitempty"`
+}
+
+type APISignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type APICommit struct {
+	Hash      string       `json:"hash"`
+	ShortHash string       `json:"short_hash"`
+	Subject   string       `json:"subject"`
+	Message   string       `json:"message"`
+	Author    APISignature `json:"author"`
+	Committer APISignature `json:"committer"`
+	Parents   []string     `json:"parents"`
+}
+
+type APITag struct {
+	Name      string `json:"name"`
+	Annotated bool   `json:"annotated"`
+	Target    string `json:"target"`
+
+	// Message, TaggerName and TaggerDate are only set for annotated tags
+	Message    string     `json:"message,omitempty"`
+	TaggerName string     `json:"tagger_name,omitempty"`
+	TaggerDate *time.Time `json:"tagger_date,omitempty"`
+}
+
+type APILog struct {
+	Ref     string      `json:"ref"`
+	Path    string      `json:"path,omitempty"`
+	View    string      `json:"view"`
+	Commits []APICommit `json:"commits"`
+	Next    string      `json:"next"`
+
+	// Truncated is set when the log stopped at the configured max depth
+	Truncated bool `json:"truncated"`
+}
+
+type APIChangedFile struct {
+	Path       string `json:"path"`
+	Deleted    bool   `json:"deleted"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+}
+
+type APIDiffStats struct {
+	FilesChanged int `json:"files_changed"`
+	Insertions   int `json:"insertions"`
+	Deletions    int `json:"deletions"`
+}
+
+type APICommitDetail struct {
+	APICommit
+	Stats APIDiffStats     `json:"stats"`
+	Files []APIChangedFile `json:"files"`
+
+	// Signed is set for commits with a PGP signature, KeyID is the ID of the
+	// key that made it when it could be read
+	Signed bool   `json:"signed"`
+	KeyID  string `json:"key_id,omitempty"`
+}
+
+type APICompare struct {
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Identical bool             `json:"identical"`
+	Commits   []APICommit      `json:"commits"`
+	Stats     APIDiffStats     `json:"stats"`
+	Files     []APIChangedFile `json:"files"`
+}
+
+type APILanguageStat struct {
+	Language string `json:"language"`
+	Lines    int    `json:"lines"`
+}
+
+type APIStats struct {
+	Commits      int               `json:"commits"`
+	Contributors int               `json:"contributors"`
+	Branches     int               `json:"branches"`
+	Tags         int               `json:"tags"`
+	Lines        int               `json:"lines"`
+	Languages    []APILanguageStat `json:"languages"`
+}
+
+type APITreeEntry struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+	Hash string `json:"hash"`
+	Type string `json:"type"`
+
+	LastModified  *time.Time `json:"last_modified,omitempty"`
+	SymlinkTarget string     `json:"symlink_target,omitempty"`
+}
+
+type APISubmodule struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash"`
+	URL    string `json:"url"`
+	WebURL string `json:"web_url,omitempty"`
+}
+
+type APITree struct {
+	Ref        string         `json:"ref"`
+	Path       string         `json:"path"`
+	Entries    []APITreeEntry `json:"entries"`
+	Submodules []APISubmodule `json:"submodules"`
+}
+
+type APIDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type APIBlob struct {
+	Ref          string          `json:"ref"`
+	Path         string          `json:"path"`
+	Encoding     string          `json:"encoding"`
+	Contents     string          `json:"contents"`
+	Dependencies []APIDependency `json:"dependencies,omitempty"`
+
+	// Size is in bytes, the contents of files larger than blob.max_size_kb
+	// are left out and Truncated is set
+	Size      int64 `json:"size"`
+	Truncated bool  `json:"truncated"`
+}
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// WantsJSON reports whether the client asked for JSON rather than HTML
+func WantsJSON(ctx *gin.Context) bool {
+	if ctx.GetBool("api") || ctx.Query("format") == "json" {
+		return true
+	}
+	return strings.Contains(ctx.GetHeader("Accept"), "application/json")
+}
+
+// RespondWith renders templateName with data, or sends the JSON API's
+// version of data when the client asked for JSON
+func RespondWith(ctx *gin.Context, templateName string, data gin.H) {
+	respondWithStatus(ctx, http.StatusOK, templateName, data)
+}
+
+func respondWithStatus(ctx *gin.Context, code int, templateName string, data gin.H) {
+	if clientGone(ctx) {
+		return
+	}
+
+	if !WantsJSON(ctx) {
+		renderHTML(ctx, code, templateName, data)
+		return
+	}
+
+	convert, ok := apiConverters[templateName]
+	if !ok {
+		ctx.JSON(http.StatusNotAcceptable, APIError{Error: "no JSON representation of this page"})
+		return
+	}
+
+	ctx.JSON(code, convert(data))
+}
+
+// renderHTML renders templateName with data as an HTML page
+func renderHTML(ctx *gin.Context, code int, templateName string, data gin.H) {
+	pushStylesheet(ctx)
+	ctx.HTML(code, templateName, data)
+}
+
+// apiConverters turn the data a template is rendered with into the JSON
+// API's representation of it
+var apiConverters = map[string]func(gin.H) interface{}{
+	"index.html":      convertIndex,
+	"repo-index.html": convertRepoIndex,
+	"log.html":        convertLog,
+	"commit.html":     convertCommit,
+	"compare.html":    convertCompare,
+	"tree.html":       convertTree,
+	"blob.html":       convertBlob,
+	"stats.html":      convertStats,
+	"tag.html":        convertTag,
+	"400.html":        convertError(http.StatusBadRequest),
+	"404.html":        convertError(http.StatusNotFound),
+	"500.html":        convertError(http.StatusInternalServerError),
+}
+
+func convertRepo(repo RepositoryWithName, language string) APIRepo {
+	return APIRepo{
+		Slug:        repo.Slug(),
+		Name:        repo.Name,
+		Title:       repo.Meta.Title,
+		Description: repo.Meta.Description,
+		Language:    language,
+		CloneURL:    repo.CloneURL,
+		SSHCloneURL: repo.SSHCloneURL,
+		ForkedFrom:  repo.Meta.ForkedFrom,
+		MirrorOf:    repo.Meta.MirrorOf,
+	}
+}
+
+func convertRefs(refs []*plumbing.Reference) []APIRef {
+	results := []APIRef{}
+	for _, ref := range refs {
+		results = append(results, APIRef{Name: ref.Name().Short(), Hash: ref.Hash().String()})
+	}
+	return results
+}
+
+func convertSignature(sig object.Signature) APISignature {
+	return APISignature{Name: sig.Name, Email: sig.Email, Date: sig.When}
+}
+
+func convertCommitObject(commit *object.Commit, shortHash string) APICommit {
+	parents := []string{}
+	for _, parent := range commit.ParentHashes {
+		parents = append(parents, parent.String())
+	}
+
+	return APICommit{
+		Hash:      commit.Hash.String(),
+		ShortHash: shortHash,
+		Subject:   strings.Split(commit.Message, "\n")[0],
+		Message:   commit.Message,
+		Author:    convertSignature(commit.Author),
+		Committer: convertSignature(commit.Committer),
+		Parents:   parents,
+	}
+}
+
+func convertIndex(data gin.H) interface{} {
+	languages, _ := data["Languages"].(map[string]string)
+
+	repos := []APIRepo{}
+	for _, repo := range data["Repos"].([]RepositoryWithName) {
+		repos = append(repos, convertRepo(repo, languages[repo.Name]))
+	}
+
+	return APIIndex{
+		Repos:     repos,
+		Page:      data["Page"].(int),
+		PerPage:   data["PerPage"].(int),
+		PageCount: data["PageCount"].(int),
+	}
+}
+
+func convertRepoIndex(data gin.H) interface{} {
+	return APIRepoIndex{
+		APIRepo:     convertRepo(data["Repo"].(RepositoryWithName), data["Language"].(string)),
+		Branches:    convertRefs(data["Branches"].([]*plumbing.Reference)),
+		BranchCount: data["BranchCount"].(int),
+		Tags:        convertRefs(data["Tags"].([]*plumbing.Reference)),
+		TagCount:    data["TagCount"].(int),
+		Readme:      string(data["Readme"].(template.HTML)),
+
+		License:      data["LicenseName"].(string),
+		Changelog:    data["ChangelogName"].(string),
+		Contributors: data["ContributorsName"].(string),
+
+		LatestRelease: data["LatestRelease"].(string),
+	}
+}
+
+func convertLog(data gin.H) interface{} {
+	commits := []APICommit{}
+	for _, c := range data["Commits"].([]Commit) {
+		commits = append(commits, convertCommitObject(c.Commit, c.ShortHash))
+	}
+
+	return APILog{
+		Ref:       data["RefName"].(string),
+		Path:      data["Path"].(string),
+		View:      data["View"].(string),
+		Commits:   commits,
+		Next:      data["NextHash"].(string),
+		Truncated: data["Truncated"].(bool),
+	}
+}
+
+func convertChangedFiles(changed []ChangedFile) []APIChangedFile {
+	files := []APIChangedFile{}
+	for _, f := range changed {
+		files = append(files, APIChangedFile{
+			Path:       f.Path,
+			Deleted:    f.Deleted,
+			Insertions: f.Insertions,
+			Deletions:  f.Deletions,
+		})
+	}
+	return files
+}
+
+func convertDiffStats(stats DiffStats) APIDiffStats {
+	return APIDiffStats{
+		FilesChanged: stats.FilesChanged,
+		Insertions:   stats.Insertions,
+		Deletions:    stats.Deletions,
+	}
+}
+
+func convertCommit(data gin.H) interface{} {
+	files := convertChangedFiles(data["Files"].([]ChangedFile))
+
+	return APICommitDetail{
+		APICommit: convertCommitObject(data["Commit"].(*object.Commit), data["ShortHash"].(string)),
+		Stats:     convertDiffStats(data["DiffStats"].(DiffStats)),
+		Files:     files,
+		Signed:    data["Commit"].(*object.Commit).PGPSignature != "",
+		KeyID:     data["KeyID"].(string),
+	}
+}
+
+func convertCompare(data gin.H) interface{} {
+	commits := []APICommit{}
+	for _, c := range data["Commits"].([]Commit) {
+		commits = append(commits, convertCommitObject(c.Commit, c.ShortHash))
+	}
+
+	files := convertChangedFiles(data["Files"].([]ChangedFile))
+
+	return APICompare{
+		From:      data["From"].(string),
+		To:        data["To"].(string),
+		Identical: data["Identical"].(bool),
+		Commits:   commits,
+		Stats:     convertDiffStats(data["DiffStats"].(DiffStats)),
+		Files:     files,
+	}
+}
+
+func convertTag(data gin.H) interface{} {
+	tag := data["Tag"].(TagDetail)
+
+	result := APITag{
+		Name:      tag.Name,
+		Annotated: tag.IsAnnotated,
+		Target:    tag.Target.String(),
+	}
+	if tag.IsAnnotated {
+		result.Message = tag.Message
+		result.TaggerName = tag.TaggerName
+		result.TaggerDate = &tag.TaggerDate
+	}
+	return result
+}
+
+func convertStats(data gin.H) interface{} {
+	stats := data["Stats"].(RepoStats)
+
+	languages := []APILanguageStat{}
+	for _, l := range stats.Languages {
+		languages = append(languages, APILanguageStat{Language: l.Language, Lines: l.Lines})
+	}
+
+	return APIStats{
+		Commits:      stats.Commits,
+		Contributors: stats.Contributors,
+		Branches:     stats.Branches,
+		Tags:         stats.Tags,
+		Lines:        stats.Lines,
+		Languages:    languages,
+	}
+}
+
+func convertTree(data gin.H) interface{} {
+	entries := []APITreeEntry{}
+	for _, entry := range data["Files"].([]TreeEntry) {
+		kind := "blob"
+		switch {
+		case entry.IsSubmodule():
+			kind = "commit"
+		case !entry.Mode.IsFile():
+			kind = "tree"
+		}
+
+		e := APITreeEntry{
+			Name:          entry.Name,
+			Mode:          entry.Mode.String(),
+			Hash:          entry.Hash.String(),
+			Type:          kind,
+			SymlinkTarget: entry.SymlinkTarget,
+		}
+		if entry.LastModified != nil {
+			e.LastModified = &entry.LastModified.Commit.Author.When
+		}
+		entries = append(entries, e)
+	}
+
+	// Submodules are listed on their own, and still among the entries as
+	// they always were
+	submodules := []APISubmodule{}
+	for _, submodule := range data["Submodules"].([]SubmoduleEntry) {
+		entries = append(entries, APITreeEntry{
+			Name: submodule.Name,
+			Mode: filemode.Submodule.String(),
+			Hash: submodule.Hash.String(),
+			Type: "commit",
+		})
+		submodules = append(submodules, APISubmodule{
+			Name:   submodule.Name,
+			Hash:   submodule.Hash.String(),
+			URL:    submodule.URL,
+			WebURL: submodule.WebURL,
+		})
+	}
+
+	return APITree{
+		Ref:        data["RefName"].(string),
+		Path:       data["Path"].(string),
+		Entries:    entries,
+		Submodules: submodules,
+	}
+}
+
+func convertBlob(data gin.H) interface{} {
+	var dependencies []APIDependency
+	for _, d := range data["Dependencies"].([]Dependency) {
+		dependencies = append(dependencies, APIDependency{Name: d.Name, Version: d.Version, Kind: d.Kind})
+	}
+
+	return APIBlob{
+		Ref:          data["RefName"].(string),
+		Path:         data["Path"].(string),
+		Encoding:     data["Encoding"].(string),
+		Contents:     data["Contents"].(string),
+		Dependencies: dependencies,
+		Size:         data["Size"].(int64),
+		Truncated:    data["ContentTruncated"].(bool),
+	}
+}
+
+func convertError(code int) func(gin.H) interface{} {
+	return func(data gin.H) interface{} {
+		if msg, ok := data["Error"].(string); ok {
+			return APIError{Error: msg}
+		}
+		return APIError{Error: http.StatusText(code)}
+	}
+}
+
+// MaxBatchCommits is the most commits CommitsBatchView returns at once
+const MaxBatchCommits = 100
+
+// CommitsBatchView returns the commits listed in the comma separated hashes
+// query parameter, in the same order, so that clients can fetch only the
+// part of a log they show.  It only exists in the JSON API.
+func CommitsBatchView(ctx *gin.Context, urlParts []string) {
+	if !ctx.GetBool("api") {
+		Http404(ctx)
+		return
+	}
+
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	var hashes []plumbing.Hash
+	for _, h := range strings.Split(ctx.Query("hashes"), ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		if !plumbing.IsHash(h) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, APIError{
+				Error: fmt.Sprintf("%q is not a full commit hash", h),
+			})
+			return
+		}
+		hashes = append(hashes, plumbing.NewHash(h))
+	}
+
+	if len(hashes) > MaxBatchCommits {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, APIError{
+			Error: fmt.Sprintf("at most %d hashes can be requested at once", MaxBatchCommits),
+		})
+		return
+	}
+
+	r := repo.Repository
+	commits := []APICommit{}
+	var missing plumbing.Hash
+
+	start := time.Now()
+	err := smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		for _, hash := range hashes {
+			commit, err := r.CommitObject(hash)
+			if err != nil {
+				missing = hash
+				return err
+			}
+
+			shortHash := ShortHash(r, commit.Hash, smithyConfig.Git.ShortHashLength)
+			commits = append(commits, convertCommitObject(commit, shortHash))
+		}
+		return nil
+	})
+	ObserveGitOperation(GitOperationLog, repoName, time.Since(start))
+
+	if err == plumbing.ErrObjectNotFound {
+		Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in repo %s", missing, repoName))
+		return
+	}
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, commits)
+}
@@ -0,0 +1,342 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Supported archive formats
+const (
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// archiveWriter adds the entries of a tree to an archive
+type archiveWriter interface {
+	WriteDir(name string, modified time.Time) error
+	WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error
+	WriteSymlink(name, target string, modified time.Time) error
+	Close() error
+}
+
+type tarGzArchiveWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzArchiveWriter(w io.Writer) *tarGzArchiveWriter {
+	gz := gzip.NewWriter(w)
+	return &tarGzArchiveWriter{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (a *tarGzArchiveWriter) WriteDir(name string, modified time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  modified,
+	})
+}
+
+func (a *tarGzArchiveWriter) WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Size:     size,
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, contents)
+	return err
+}
+
+func (a *tarGzArchiveWriter) WriteSymlink(name, target string, modified time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modified,
+	})
+}
+
+func (a *tarGzArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func newZipArchiveWriter(w io.Writer) *zipArchiveWriter {
+	return &zipArchiveWriter{zw: zip.NewWriter(w)}
+}
+
+func (a *zipArchiveWriter) create(name string, mode os.FileMode, modified time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	}
+	header.SetMode(mode)
+	return a.zw.CreateHeader(header)
+}
+
+func (a *zipArchiveWriter) WriteDir(name string, modified time.Time) error {
+	_, err := a.create(name+"/", os.ModeDir|0755, modified)
+	return err
+}
+
+func (a *zipArchiveWriter) WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error {
+	w, err := a.create(name, mode, modified)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+func (a *zipArchiveWriter) WriteSymlink(name, target string, modified time.Time) error {
+	w, err := a.create(name, os.ModeSymlink|0777, modified)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// ListTreeEntriesRecursive returns every entry below tree, named by its
+// full path
+func ListTreeEntriesRecursive(tree *object.Tree) ([]TreeEntry, error) {
+	var results []TreeEntry
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		results = append(results, TreeEntry{
+			Name: name,
+			Mode: entry.Mode,
+			Hash: entry.Hash,
+		})
+	}
+}
+
+// WriteArchive writes entries from r to archive, below prefix
+func WriteArchive(archive archiveWriter, r *git.Repository, entries []TreeEntry, prefix string, modified time.Time) error {
+	for _, entry := range entries {
+		name := path.Join(prefix, entry.Name)
+
+		if entry.IsSubmodule() {
+			if err := archive.WriteDir(name, modified); err != nil {
+				return err
+			}
+			continue
+		}
+
+		blob, err := r.BlobObject(entry.Hash)
+		if err != nil {
+			return err
+		}
+
+		reader, err := blob.Reader()
+		if err != nil {
+			return err
+		}
+
+		if entry.Mode == filemode.Symlink {
+			target, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			if err := archive.WriteSymlink(name, string(target), modified); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mode, err := entry.Mode.ToOSFileMode()
+		if err != nil {
+			reader.Close()
+			return err
+		}
+
+		err = archive.WriteFile(name, mode, blob.Size, modified, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// CommitInfoFile is added to archives to tell where their contents came from
+const CommitInfoFile = "COMMIT_INFO.txt"
+
+// CommitInfo describes commit for CommitInfoFile, remote is the URL the
+// repository can be cloned from and left out when empty
+func CommitInfo(commit *object.Commit, remote string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Commit:  %s\n", commit.Hash)
+	fmt.Fprintf(&b, "Author:  %s <%s>\n", commit.Author.Name, commit.Author.Email)
+	fmt.Fprintf(&b, "Date:    %s\n", commit.Author.When.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Subject: %s\n", strings.SplitN(commit.Message, "\n", 2)[0])
+	if remote != "" {
+		fmt.Fprintf(&b, "Remote:  %s\n", remote)
+	}
+	return b.String()
+}
+
+// writeCommitInfo adds CommitInfoFile to archive below prefix, unless the
+// repository has a file of that name itself
+func writeCommitInfo(archive archiveWriter, entries []TreeEntry, prefix, info string, modified time.Time) error {
+	for _, entry := range entries {
+		if entry.Name == CommitInfoFile {
+			return nil
+		}
+	}
+
+	return archive.WriteFile(path.Join(prefix, CommitInfoFile), 0644, int64(len(info)), modified, strings.NewReader(info))
+}
+
+// ArchiveView streams a snapshot of a repository at a ref as a tar.gz or
+// zip archive
+func ArchiveView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	r := repo.Repository
+	refNameString := urlParts[1]
+	format := urlParts[2]
+
+	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
+		return
+	}
+
+	commitObj, err := r.CommitObject(*revision)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	tree, err := commitObj.Tree()
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	entries, err := ListTreeEntriesRecursive(tree)
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	if patterns := smithyConfig.Exclude.Patterns; len(patterns) > 0 {
+		entries = FilterTreeEntries(entries, func(entry TreeEntry) bool {
+			return !MatchesExcludePattern(entry.Name, patterns)
+		})
+	}
+
+	if ctx.Query("include-submodules") == "false" {
+		entries = FilterTreeEntries(entries, func(entry TreeEntry) bool {
+			return !entry.IsSubmodule()
+		})
+	}
+
+	// Namespaced slugs would put a directory in the archive's file name
+	prefix := fmt.Sprintf("%s-%s", strings.ReplaceAll(repoName, "/", "-"), refNameString)
+
+	var archive archiveWriter
+	var contentType string
+
+	switch format {
+	case ArchiveZip:
+		archive = newZipArchiveWriter(ctx.Writer)
+		contentType = "application/zip"
+	default:
+		archive = newTarGzArchiveWriter(ctx.Writer)
+		contentType = "application/gzip"
+	}
+
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", prefix+"."+format))
+	ctx.Status(http.StatusOK)
+
+	info := CommitInfo(commitObj, repo.CloneURL)
+
+	// The status has been sent, errors from here on can only be logged
+	err = writeCommitInfo(archive, entries, prefix, info, commitObj.Committer.When)
+	if err == nil {
+		err = WriteArchive(archive, r, entries, prefix, commitObj.Committer.When)
+	}
+	if err != nil {
+		ctx.Error(err)
+	}
+}
@@ -0,0 +1,239 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// BlameIgnoreRevsFile lists commits, such as mass reformatting, that blame
+// looks through
+const BlameIgnoreRevsFile = ".git-blame-ignore-revs"
+
+// LoadBlameIgnoreRevs reads the full hashes listed in the
+// .git-blame-ignore-revs file at the root of commit, skipping comments and
+// anything that isn't a hash.  A missing file lists nothing.
+func LoadBlameIgnoreRevs(commit *object.Commit) ([]plumbing.Hash, error) {
+	f, err := commit.File(BlameIgnoreRevsFile)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []plumbing.Hash
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		if plumbing.IsHash(line) {
+			hashes = append(hashes, plumbing.NewHash(line))
+		}
+	}
+
+	return hashes, scanner.Err()
+}
+
+// lineMapping returns, for each line of to, the index of the same line in
+// from, or -1 when there isn't one.  A line in a block of lines that
+// replaced others maps to the line at the same offset in the replaced
+// block, like git does when it looks through ignored revisions.
+func lineMapping(from, to string) []int {
+	dmp := diffmatchpatch.New()
+	a, b, lineArray := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lineArray)
+
+	mapping := make([]int, 0, len(splitLines(to)))
+	fromIndex := 0
+	deletedStart, deletedCount := 0, 0
+
+	for _, d := range diffs {
+		n := len(splitLines(d.Text))
+
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			for i := 0; i < n; i++ {
+				mapping = append(mapping, fromIndex+i)
+			}
+			fromIndex += n
+			deletedCount = 0
+		case diffmatchpatch.DiffDelete:
+			deletedStart, deletedCount = fromIndex, n
+			fromIndex += n
+		case diffmatchpatch.DiffInsert:
+			for i := 0; i < n; i++ {
+				if i < deletedCount {
+					mapping = append(mapping, deletedStart+i)
+				} else {
+					mapping = append(mapping, -1)
+				}
+			}
+			deletedCount = 0
+		}
+	}
+
+	return mapping
+}
+
+// fileContents returns the contents of path at commit
+func fileContents(commit *object.Commit, path string) (string, error) {
+	f, err := commit.File(path)
+	if err != nil {
+		return "", err
+	}
+	return f.Contents()
+}
+
+// blameIgnoring blames path at commit, attributing the lines changed by
+// the ignored commits to the commits before them
+type blameIgnoring struct {
+	r       *git.Repository
+	path    string
+	ignored map[plumbing.Hash]bool
+
+	// blames of path at the commits visited so far
+	cache map[plumbing.Hash][]*git.Line
+}
+
+// BlameIgnoringRevs is git.Blame, except that lines last changed by one of
+// the ignored commits are attributed to the commit that changed them
+// before, when it can be found
+func BlameIgnoringRevs(r *git.Repository, commit *object.Commit, path string, ignored []plumbing.Hash) ([]*git.Line, error) {
+	b := blameIgnoring{
+		r:       r,
+		path:    path,
+		ignored: map[plumbing.Hash]bool{},
+		cache:   map[plumbing.Hash][]*git.Line{},
+	}
+	for _, hash := range ignored {
+		b.ignored[hash] = true
+	}
+
+	return b.blame(commit)
+}
+
+func (b *blameIgnoring) blame(commit *object.Commit) ([]*git.Line, error) {
+	if lines, ok := b.cache[commit.Hash]; ok {
+		return lines, nil
+	}
+
+	result, err := git.Blame(commit, b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the lines, the ones attributed to ignored commits are replaced
+	lines := make([]*git.Line, len(result.Lines))
+	copy(lines, result.Lines)
+
+	// Each ignored commit is looked through once, however many lines it
+	// changed
+	var contents string
+	previous := map[plumbing.Hash][]*git.Line{}
+
+	for i, line := range lines {
+		if !b.ignored[line.Hash] {
+			continue
+		}
+
+		if contents == "" {
+			if contents, err = fileContents(commit, b.path); err != nil {
+				return nil, err
+			}
+		}
+
+		before, ok := previous[line.Hash]
+		if !ok {
+			before = b.before(line.Hash, contents)
+			previous[line.Hash] = before
+		}
+
+		if i < len(before) && before[i] != nil {
+			lines[i] = &git.Line{
+				Author: before[i].Author,
+				Text:   line.Text,
+				Date:   before[i].Date,
+				Hash:   before[i].Hash,
+			}
+		}
+	}
+
+	b.cache[commit.Hash] = lines
+	return lines, nil
+}
+
+// before finds who changed each line of contents before the ignored commit
+// hash did.  Lines that can't be followed into its parent are nil.
+func (b *blameIgnoring) before(hash plumbing.Hash, contents string) []*git.Line {
+	ignored, err := b.r.CommitObject(hash)
+	if err != nil || ignored.NumParents() == 0 {
+		return nil
+	}
+
+	parent, err := ignored.Parent(0)
+	if err != nil {
+		return nil
+	}
+
+	ignoredContents, err := fileContents(ignored, b.path)
+	if err != nil {
+		return nil
+	}
+
+	parentContents, err := fileContents(parent, b.path)
+	if err != nil {
+		return nil
+	}
+
+	parentLines, err := b.blame(parent)
+	if err != nil {
+		return nil
+	}
+
+	// From each line in contents to the same line in the ignored commit,
+	// and on to the line it replaced in its parent
+	toIgnored := lineMapping(ignoredContents, contents)
+	toParent := lineMapping(parentContents, ignoredContents)
+
+	before := make([]*git.Line, len(toIgnored))
+	for i, j := range toIgnored {
+		if j < 0 || j >= len(toParent) {
+			continue
+		}
+		if k := toParent[j]; k >= 0 && k < len(parentLines) {
+			before[i] = parentLines[k]
+		}
+	}
+
+	return before
+}
@@ -0,0 +1,151 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache keeps the most recently used rendered READMEs and diffs.  Their
+// inputs are addressed by hash and never change, so entries only go once
+// the cache is full, they're older than the TTL, or it's flushed.  A nil
+// Cache renders every time.
+type Cache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+
+	// flight makes concurrent misses of the same key render it only once
+	flight singleflight.Group
+}
+
+type cacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// NewCache creates a cache holding up to maxEntries values for ttl each, or
+// for as long as there's room when ttl is 0.  It returns nil, which caches
+// nothing, when maxEntries is 0.
+func NewCache(maxEntries int, ttl time.Duration) *Cache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &Cache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the value cached for key
+func (c *Cache) Get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return "", false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Add caches value for key, evicting the least recently used value when
+// the cache is full
+func (c *Cache) Add(key, value string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// GetOrRender returns the value cached for key, rendering and caching it
+// when it's missing.  Failed renders aren't cached.
+func (c *Cache) GetOrRender(key string, render func() (string, error)) (string, error) {
+	if c == nil {
+		return render()
+	}
+
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	v, err, _ := c.flight.Do(key, func() (interface{}, error) {
+		value, err := render()
+		if err != nil {
+			return "", err
+		}
+		c.Add(key, value)
+		return value, nil
+	})
+	return v.(string), err
+}
+
+// Flush empties the cache and returns how many entries it held
+func (c *Cache) Flush() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.order.Len()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return n
+}
@@ -0,0 +1,99 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// CloneStateFile records the repositories imported with `smithy clone`.  It
+// lives in the git root, one "<slug> <remote>" pair per line.  Running
+// servers load repositories again whenever it changes, see
+// WatchRepositories.
+const CloneStateFile = ".smithy-clones"
+
+// SlugFromRemote derives a repository slug from a remote URL, e.g.
+// https://example.com/org/project.git becomes "project"
+func SlugFromRemote(remote string) string {
+	remote = strings.TrimRight(remote, "/")
+	if i := strings.LastIndexAny(remote, "/:"); i != -1 {
+		remote = remote[i+1:]
+	}
+	return strings.TrimSuffix(remote, ".git")
+}
+
+// CloneRepository clones remote into the git root, makes sure the new
+// repository is picked up by the configuration and records it in the
+// CloneStateFile, which tells running servers about it
+func CloneRepository(config *SmithyConfig, remote, slug string, bare bool, progress io.Writer) error {
+	if slug == "" {
+		slug = SlugFromRemote(remote)
+	}
+
+	if slug == "" || strings.Contains(slug, "/") {
+		return fmt.Errorf("invalid repository slug %q", slug)
+	}
+
+	repoPath := path.Join(config.Git.Root, slug)
+
+	exists, err := PathExists(repoPath)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("%s already exists", repoPath)
+	}
+
+	_, err = git.PlainClone(repoPath, bare, &git.CloneOptions{
+		URL:      remote,
+		Progress: progress,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	state, err := os.OpenFile(path.Join(config.Git.Root, CloneStateFile),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	_, err = fmt.Fprintf(state, "%s %s\n", slug, remote)
+	if err != nil {
+		return err
+	}
+
+	err = config.LoadAllRepositories()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := config.FindRepo(slug); !exists {
+		return fmt.Errorf("%s was cloned but is not a valid repository", slug)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCompressionLevel is the gzip level responses are compressed with
+// unless compression.level says otherwise
+const DefaultCompressionLevel = 6
+
+// compressibleTypes are the content types worth gzipping, anything else,
+// like archives and packfiles, is compressed already
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+// CompressionMiddleware gzips responses of at least config.MinSize bytes
+// for clients that accept it.  It has to come before gin.Recovery so that
+// error pages go through it too.
+func CompressionMiddleware(config CompressionConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// HEAD responses have no body, and their Content-Length should be
+		// the one of the uncompressed GET response
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.Request) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer, config: config}
+		c.Writer = writer
+		c.Next()
+		writer.finish()
+		c.Writer = writer.ResponseWriter
+	}
+}
+
+// acceptsGzip reports whether the client accepts gzipped responses
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := mime.ParseMediaType(strings.TrimSpace(encoding))
+		if name == "gzip" && params["q"] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a response with header should be gzipped
+func compressible(status int, header http.Header) bool {
+	if status == http.StatusPartialContent || header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds a response back until it's known to be large
+// enough to be compressed, or until it's finished
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	config CompressionConfig
+	status int
+	size   int
+	buf    []byte
+
+	// started is set once the headers have been sent, gz is only set when
+	// the response is being compressed
+	started bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if !w.started {
+		w.status = code
+	}
+}
+
+func (w *gzipResponseWriter) WriteHeaderNow() {}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.size += len(data)
+
+	if !w.started {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) >= w.config.MinSize {
+			if err := w.start(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what there is so far, compressed as streamed responses can't
+// be measured up front
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *gzipResponseWriter) Size() int {
+	return w.size
+}
+
+func (w *gzipResponseWriter) Written() bool {
+	return w.started || w.status != 0 || w.size > 0
+}
+
+// start sends the headers, deciding whether the response is compressed,
+// followed by whatever has been held back
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+
+	if compressible(w.Status(), header) {
+		header.Add("Vary", "Accept-Encoding")
+
+		if compress {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+
+			gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.config.Level)
+			if err != nil {
+				return err
+			}
+			w.gz = gz
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.Status())
+	w.ResponseWriter.WriteHeaderNow()
+
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else if len(w.buf) > 0 {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// finish sends responses too small to be compressed and ends compressed
+// ones
+func (w *gzipResponseWriter) finish() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -17,50 +17,471 @@
 package smithy
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/alecthomas/chroma/styles"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"gopkg.in/yaml.v2"
 )
 
+// ErrOperationTimeout is returned when a git operation takes longer than
+// the configured timeout
+var ErrOperationTimeout = errors.New("git operation timed out")
+
 type RepoConfig struct {
-	Path        string
-	Slug        string
-	Title       string
-	Description string
-	Exclude     bool
+	Path        string `json:"path"`
+	Slug        string `json:"slug"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Exclude     bool   `json:"exclude"`
+	// DefaultBranch overrides the global default branch for this repository.
+	// When neither is set, it's filled in from HEAD as repositories are
+	// loaded.
+	DefaultBranch string `yaml:"default_branch" json:"default_branch"`
+	// StaticDir is served at /<repo>/static/, relative paths are resolved
+	// against the repository's directory
+	StaticDir string `yaml:"static_dir" json:"static_dir"`
+	// DocsPath is the directory in the repository rendered at /<repo>/docs/,
+	// DefaultDocsPath when empty
+	DocsPath string `yaml:"docs_path" json:"docs_path"`
+	// CloneURL and SSHCloneURL are shown on the repository's page, they're
+	// derived from the host when empty
+	CloneURL    string `yaml:"clone_url" json:"clone_url"`
+	SSHCloneURL string `yaml:"ssh_clone_url" json:"ssh_clone_url"`
+	// ForkedFrom and MirrorOf name the upstream of forks and mirrors, e.g.
+	// example.com/original
+	ForkedFrom string `yaml:"forked_from" json:"forked_from"`
+	MirrorOf   string `yaml:"mirror_of" json:"mirror_of"`
+	// VersionPattern finds releases in commit subjects, its first group is
+	// the version, e.g. ^Release (\d+\.\d+\.\d+)$
+	VersionPattern string `yaml:"version_pattern" json:"version_pattern"`
+}
+
+// DefaultDocsPath is where documentation is looked for unless configured
+const DefaultDocsPath = "docs"
+
+// Docs returns the directory documentation is rendered from
+func (rc RepoConfig) Docs() string {
+	if rc.DocsPath == "" {
+		return DefaultDocsPath
+	}
+	return strings.Trim(rc.DocsPath, "/")
 }
 
 type GitConfig struct {
-	Root  string       `yaml:"root"`
-	Repos []RepoConfig `yaml:",omitempty"`
+	Root  string       `yaml:"root" json:"root"`
+	Repos []RepoConfig `yaml:",omitempty" json:"repos,omitempty"`
+
+	// OperationTimeout bounds how long a single git operation may take, as
+	// a Go duration such as "10s".  Empty means no limit.
+	OperationTimeout string `yaml:"operation_timeout" json:"operation_timeout"`
+
+	// operationTimeout is the parsed value of OperationTimeout
+	operationTimeout time.Duration
+
+	// HTTPClone serves repositories over git's smart HTTP protocol so that
+	// they can be cloned from smithy
+	HTTPClone bool `yaml:"http_clone" json:"http_clone"`
+
+	// ShortHashLength is how many characters of a hash are shown, commits
+	// get more when that's ambiguous
+	ShortHashLength int `yaml:"short_hash_length" json:"short_hash_length"`
+
+	// ResolveSubmoduleURLs links submodules in tree listings to the web
+	// page of the repository they point at
+	ResolveSubmoduleURLs bool `yaml:"resolve_submodule_urls" json:"resolve_submodule_urls"`
+
+	// Watch picks up repositories that are added to or removed from Root
+	// while smithy is running
+	Watch bool `yaml:"watch" json:"watch"`
 
 	// ReposBySlug is an extrapolaed value
 	reposBySlug map[string]RepositoryWithName
 
 	// staticReposBySlug is a map of the `repos` values
 	staticReposBySlug map[string]RepoConfig
+
+	// loaded is set once LoadAllRepositories has finished
+	loaded bool
 }
 
 type StaticConfig struct {
-	Root   string
-	Prefix string
+	Root   string `json:"root"`
+	Prefix string `json:"prefix"`
+}
+
+type TemplatesConfig struct {
+	Dir string `json:"dir"`
+
+	// Extensions lists the file extensions that are loaded as templates
+	Extensions []string `json:"extensions"`
+
+	// Cache is one of "startup", "request" or "ttl"
+	Cache string `json:"cache"`
+
+	// TTL is how long templates are cached for with the "ttl" strategy
+	TTL string `yaml:"ttl" json:"ttl"`
+}
+
+type IndexConfig struct {
+	// MaxBranchesShown limits the branches and tags listed on a repository's
+	// index page, 0 shows all of them
+	MaxBranchesShown int `yaml:"max_branches_shown" json:"max_branches_shown"`
+	// Layout is one of "table", "card" or "compact"
+	Layout string `yaml:"layout" json:"layout"`
+	// DefaultPageSize is how many repositories are listed per page
+	DefaultPageSize int `yaml:"default_page_size" json:"default_page_size"`
+	// ShowSlug shows a repository's slug next to its name where they
+	// differ, which helps to find conflicting slugs
+	ShowSlug bool `yaml:"show_slug" json:"show_slug"`
+}
+
+type ExcludeConfig struct {
+	// Patterns are globs, with support for `**`, of paths that are left out
+	// of archives, language detection and repository stats
+	Patterns []string `yaml:"patterns" json:"patterns"`
+}
+
+type LogConfig struct {
+	// MaxSubjectLength is how many characters of a commit subject are shown
+	// in the log before it is cut off, 0 shows it in full
+	MaxSubjectLength int `yaml:"max_subject_length" json:"max_subject_length"`
+
+	// MaxDepth is how many commits the log walks across all of its pages,
+	// 0 means no limit
+	MaxDepth int `yaml:"max_depth" json:"max_depth"`
+
+	// Format is how requests are written to the access log, LogFormatText
+	// or LogFormatJSON
+	Format string `yaml:"format" json:"format"`
+}
+
+type BlobConfig struct {
+	// MaxSizeKB is the size of the largest file shown, larger ones only
+	// link to their raw contents.  0 means no limit.
+	MaxSizeKB int `yaml:"max_size_kb" json:"max_size_kb"`
+}
+
+type MetricsConfig struct {
+	// Enabled serves Prometheus metrics at MetricsPath
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+type CacheConfig struct {
+	// MaxEntries is how many rendered READMEs and diffs are kept, 0 turns
+	// the cache off
+	MaxEntries int `yaml:"max_entries" json:"max_entries"`
+
+	// TTL is how long an entry is kept for, as a Go duration such as "1h".
+	// Empty keeps entries until they're evicted.
+	TTL string `yaml:"ttl" json:"ttl"`
+}
+
+type AdminConfig struct {
+	// Secret is the bearer token admin endpoints require, they're turned
+	// off while it's empty
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+type CompressionConfig struct {
+	// Enabled gzips responses for clients that accept it
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// Level is the gzip compression level, from 1 (fastest) to 9 (smallest)
+	Level int `yaml:"level" json:"level"`
+
+	// MinSize is the smallest response, in bytes, that is compressed
+	MinSize int `yaml:"min_size" json:"min_size"`
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate and its key
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+
+	// AutoTLS gets a certificate for the host from Let's Encrypt, which is
+	// kept in CacheDir
+	AutoTLS  bool   `yaml:"auto_tls" json:"auto_tls"`
+	CacheDir string `yaml:"cache_dir" json:"cache_dir"`
+
+	// HTTP2 offers HTTP/2 to clients, ServerPush then pushes the stylesheet
+	// along with pages
+	HTTP2      bool `yaml:"http2" json:"http2"`
+	ServerPush bool `yaml:"server_push" json:"server_push"`
+}
+
+// Enabled reports whether smithy serves HTTPS itself
+func (tc TLSConfig) Enabled() bool {
+	return tc.AutoTLS || tc.CertFile != ""
+}
+
+func (tc TLSConfig) validate(host string) error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+
+	if !tc.AutoTLS {
+		return nil
+	}
+
+	if tc.CertFile != "" {
+		return errors.New("tls.auto_tls can't be used with tls.cert_file")
+	}
+
+	if tc.CacheDir == "" {
+		return errors.New("tls.auto_tls requires tls.cache_dir")
+	}
+
+	if host == "" || host == "localhost" {
+		return errors.New("tls.auto_tls requires the host to get a certificate for")
+	}
+
+	return nil
+}
+
+type DiffConfig struct {
+	// ContextLines is how many unchanged lines are shown around changes
+	ContextLines int `yaml:"context_lines" json:"context_lines"`
+
+	// MaxContextLines caps the ?context= query parameter of commits
+	MaxContextLines int `yaml:"max_context_lines" json:"max_context_lines"`
+
+	// MaxFileDiffBytes is the largest diff of a single file that's shown,
+	// larger ones are replaced by a link to the patch.  0 means no limit.
+	MaxFileDiffBytes int `yaml:"max_file_diff_bytes" json:"max_file_diff_bytes"`
+}
+
+type MarkdownConfig struct {
+	// GenerateTOC puts a table of contents linking to the second and third
+	// level headings at the top of rendered READMEs and docs
+	GenerateTOC bool `yaml:"generate_toc" json:"generate_toc"`
+}
+
+type TagsConfig struct {
+	// SortBy is one of "name", "date" or "semver"
+	SortBy string `yaml:"sort_by" json:"sort_by"`
+}
+
+type TreeConfig struct {
+	// HideDotFiles leaves files and directories starting with a dot out of
+	// tree listings
+	HideDotFiles bool `yaml:"hide_dot_files" json:"hide_dot_files"`
+
+	// ShowLastModified shows the latest commit that touched each entry,
+	// which is slow for large repositories
+	ShowLastModified bool `yaml:"show_last_modified" json:"show_last_modified"`
+}
+
+type FeedConfig struct {
+	// IncludeDiffStats adds the files changed and lines inserted and
+	// deleted by each commit to the Atom feed
+	IncludeDiffStats bool `yaml:"include_diff_stats" json:"include_diff_stats"`
+}
+
+type HighlightConfig struct {
+	// InlineCSS styles highlighted code with inline styles rather than
+	// classes so that pages don't depend on an external stylesheet
+	InlineCSS bool `yaml:"inline_css" json:"inline_css"`
+
+	// Style is the name of the chroma style code is highlighted with, see
+	// `smithy config list-highlight-styles`
+	Style string `yaml:"style" json:"style"`
+}
+
+// LinkPattern turns text in commit messages that matches Regex into a link
+// to URL, in which $1 and friends are replaced with the regex's groups
+type LinkPattern struct {
+	Regex string `yaml:"regex" json:"regex"`
+	URL   string `yaml:"url" json:"url"`
+	Label string `yaml:"label" json:"label"`
+	regex *regexp.Regexp
+}
+
+// RedirectRule sends requests whose path matches From to To, e.g. after a
+// repository was renamed.  From is a regular expression matched against the
+// whole path and $1 and friends in To are replaced with its groups.
+type RedirectRule struct {
+	From  string `yaml:"from" json:"from"`
+	To    string `yaml:"to" json:"to"`
+	Code  int    `yaml:"code" json:"code"`
+	regex *regexp.Regexp
 }
 
 type SmithyConfig struct {
-	Title       string `yaml:"title"`
-	Description string `yaml:"description"`
-	Host        string `yaml:"host"`
-	Git         GitConfig
-	Static      StaticConfig
-	Templates   struct {
-		Dir string
+	Title       string            `yaml:"title" json:"title"`
+	Description string            `yaml:"description" json:"description"`
+	Host        string            `yaml:"host" json:"host"`
+	Git         GitConfig         `json:"git"`
+	Static      StaticConfig      `json:"static"`
+	Templates   TemplatesConfig   `json:"templates"`
+	Index       IndexConfig       `json:"index"`
+	Exclude     ExcludeConfig     `json:"exclude"`
+	Log         LogConfig         `json:"log"`
+	Diff        DiffConfig        `json:"diff"`
+	Tags        TagsConfig        `json:"tags"`
+	Markdown    MarkdownConfig    `json:"markdown"`
+	Tree        TreeConfig        `json:"tree"`
+	Feed        FeedConfig        `json:"feed"`
+	Highlight   HighlightConfig   `json:"highlight"`
+	Blob        BlobConfig        `json:"blob"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	Compression CompressionConfig `json:"compression"`
+	Cache       CacheConfig       `json:"cache"`
+	Admin       AdminConfig       `json:"admin"`
+	TLS         TLSConfig         `json:"tls"`
+	Port        int               `yaml:"port" json:"port"`
+
+	// ListenAddress is the interface smithy binds to along with Port, all
+	// of them when it's empty
+	ListenAddress string `yaml:"listen_address" json:"listen_address"`
+
+	// UnixSocket is the path of a Unix domain socket smithy listens on
+	// instead of ListenAddress and Port
+	UnixSocket string `yaml:"unix_socket" json:"unix_socket"`
+
+	// MaxRequestBodyBytes caps the size of incoming request bodies
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes" json:"max_request_body_bytes"`
+
+	// ForceHTTPS redirects requests a proxy received over plain HTTP
+	ForceHTTPS bool `yaml:"force_https" json:"force_https"`
+
+	// Prefix is the path smithy is served under, e.g. "/git"
+	Prefix string `yaml:"prefix" json:"prefix"`
+
+	// CommitLinkPatterns link references to external trackers in commit
+	// messages
+	CommitLinkPatterns []LinkPattern `yaml:"commit_link_patterns" json:"commit_link_patterns"`
+
+	// Redirects are checked before routing, see RedirectRule
+	Redirects []RedirectRule `yaml:"redirects" json:"redirects"`
+
+	// DefaultBranch is the branch shown when no ref is given, HEAD is used
+	// when it's empty
+	DefaultBranch string `yaml:"default_branch" json:"default_branch"`
+
+	// CustomCSS is added to the <head> of every page
+	CustomCSS string `yaml:"custom_css" json:"custom_css"`
+	// CustomCSSFile is a file whose contents are added after CustomCSS
+	CustomCSSFile string `yaml:"custom_css_file" json:"custom_css_file"`
+	customCSS     template.CSS
+
+	// CustomJS is run at the end of every page
+	CustomJS string `yaml:"custom_js" json:"custom_js"`
+	// CustomJSFile is a file whose contents are run after CustomJS
+	CustomJSFile string `yaml:"custom_js_file" json:"custom_js_file"`
+	customJS     template.JS
+
+	// renderCache is shared by every copy of the configuration
+	renderCache *Cache
+}
+
+// SanitizeCSS escapes every "<" in css so that it can't close the <style>
+// element it is placed in
+func SanitizeCSS(css string) string {
+	return strings.ReplaceAll(css, "<", `\3c `)
+}
+
+func (sc *SmithyConfig) loadCustomCSS() error {
+	css := sc.CustomCSS
+
+	if sc.CustomCSSFile != "" {
+		contents, err := ioutil.ReadFile(sc.CustomCSSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read custom css: %w", err)
+		}
+		css += "\n" + string(contents)
+	}
+
+	sc.customCSS = template.CSS(SanitizeCSS(css))
+	return nil
+}
+
+// scriptOpenRegexp matches "<script", which after a "<!--" stops the next
+// </script> from closing the element
+var scriptOpenRegexp = regexp.MustCompile(`(?i)<script`)
+
+// SanitizeJS escapes every "</" and "<script" in js so that it can't close
+// the <script> element it is placed in or keep it from being closed.  The
+// "<" of "<script" becomes \x3C, which means the same in strings and
+// regular expressions.
+func SanitizeJS(js string) string {
+	js = strings.ReplaceAll(js, "</", `<\/`)
+	return scriptOpenRegexp.ReplaceAllStringFunc(js, func(s string) string {
+		return `\x3C` + s[1:]
+	})
+}
+
+func (sc *SmithyConfig) loadCustomJS() error {
+	js := sc.CustomJS
+
+	if sc.CustomJSFile != "" {
+		contents, err := ioutil.ReadFile(sc.CustomJSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read custom js: %w", err)
+		}
+		js += "\n" + string(contents)
+	}
+
+	sc.customJS = template.JS(SanitizeJS(js))
+	return nil
+}
+
+func (sc *SmithyConfig) compileLinkPatterns() error {
+	for i, pattern := range sc.CommitLinkPatterns {
+		regex, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid commit link pattern %q: %w", pattern.Regex, err)
+		}
+		sc.CommitLinkPatterns[i].regex = regex
+	}
+	return nil
+}
+
+func (sc *SmithyConfig) compileRedirects() error {
+	for i, rule := range sc.Redirects {
+		regex, err := regexp.Compile("^(?:" + rule.From + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid redirect %q: %w", rule.From, err)
+		}
+		sc.Redirects[i].regex = regex
+
+		switch rule.Code {
+		case 0:
+			sc.Redirects[i].Code = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound:
+		default:
+			return fmt.Errorf("invalid redirect code %d for %q, must be 301 or 302", rule.Code, rule.From)
+		}
+	}
+	return nil
+}
+
+// DiffOptions returns how diffs are rendered
+func (sc *SmithyConfig) DiffOptions() DiffOptions {
+	return DiffOptions{
+		ContextLines:     sc.Diff.ContextLines,
+		ShortHashLength:  sc.Git.ShortHashLength,
+		MaxFileDiffBytes: sc.Diff.MaxFileDiffBytes,
 	}
-	Port int `yaml:"port"`
 }
 
 func (sc *SmithyConfig) findStaticRepo(slug string) (RepoConfig, bool) {
@@ -69,7 +490,12 @@ func (sc *SmithyConfig) findStaticRepo(slug string) (RepoConfig, bool) {
 }
 
 func (sc *SmithyConfig) FindRepo(slug string) (RepositoryWithName, bool) {
-	value, exists := sc.Git.reposBySlug[slug]
+	// Namespaced slugs may come with their slashes escaped
+	if unescaped, err := url.PathUnescape(slug); err == nil {
+		slug = unescaped
+	}
+
+	value, exists := sc.Git.reposBySlug[strings.Trim(slug, "/")]
 	return value, exists
 }
 
@@ -84,10 +510,145 @@ func (sc *SmithyConfig) GetRepositories() []RepositoryWithName {
 	return repos
 }
 
+// GetRepositoriesPage returns the given 1-based page of repositories along
+// with the total number of repositories
+func (sc *SmithyConfig) GetRepositoriesPage(page, perPage int) ([]RepositoryWithName, int) {
+	repos := sc.GetRepositories()
+	total := len(repos)
+
+	start := (page - 1) * perPage
+	if page < 1 || perPage < 1 || start >= total {
+		return []RepositoryWithName{}, total
+	}
+
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	return repos[start:end], total
+}
+
+// WithGitTimeout runs fn, giving up on it once the configured operation
+// timeout has passed or parent is done.  go-git can't be interrupted, so fn
+// carries on in the background until it next checks the context it's
+// given.  It mustn't touch the request's gin.Context or anything the caller
+// closes once it returns, and its results must be ignored after an error.
+func (sc *SmithyConfig) WithGitTimeout(parent context.Context, fn func(ctx context.Context) error) error {
+	if sc.Git.operationTimeout <= 0 {
+		return fn(parent)
+	}
+
+	ctx, cancel := context.WithTimeout(parent, sc.Git.operationTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			return ErrOperationTimeout
+		}
+		return err
+	case <-ctx.Done():
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return ErrOperationTimeout
+	}
+}
+
+// OpenRepositoryWithEnv opens the repository at path like git.PlainOpen,
+// except that when GIT_DIR names a directory within path, that's used as
+// its git directory in place of .git
+func OpenRepositoryWithEnv(path string) (*git.Repository, error) {
+	dotGitPath, ok := gitDirFromEnv(path)
+	if !ok {
+		return git.PlainOpen(path)
+	}
+
+	// A GIT_DIR of "." is a bare repository, which has no worktree
+	var worktree billy.Filesystem
+	if dotGitPath != filepath.Clean(path) {
+		worktree = osfs.New(path)
+	}
+
+	storage := filesystem.NewStorage(osfs.New(dotGitPath), cache.NewObjectLRUDefault())
+	return git.Open(storage, worktree)
+}
+
+// gitDirFromEnv returns the directory GIT_DIR names within path, if it
+// names one
+func gitDirFromEnv(path string) (string, bool) {
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		return "", false
+	}
+
+	dotGitPath := filepath.Join(path, gitDir)
+	if info, err := os.Stat(dotGitPath); err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	return dotGitPath, true
+}
+
+// openRepository opens the repository at repoPath within the operation
+// timeout
+func (sc *SmithyConfig) openRepository(repoPath string) (*git.Repository, error) {
+	var r *git.Repository
+
+	err := sc.WithGitTimeout(context.Background(), func(ctx context.Context) error {
+		var err error
+		r, err = OpenRepositoryWithEnv(repoPath)
+		return err
+	})
+
+	if err == ErrOperationTimeout {
+		fmt.Println("Timed out opening repository:", repoPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
 func (sc *SmithyConfig) LoadAllRepositories() error {
+	sc.Git.operationTimeout = 0
+	if sc.Git.OperationTimeout != "" {
+		timeout, err := time.ParseDuration(sc.Git.OperationTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid git operation timeout: %w", err)
+		}
+		sc.Git.operationTimeout = timeout
+	}
+
+	if sc.Git.ShortHashLength < MinShortHashLength || sc.Git.ShortHashLength > MaxShortHashLength {
+		return fmt.Errorf("invalid short hash length %d, must be between %d and %d",
+			sc.Git.ShortHashLength, MinShortHashLength, MaxShortHashLength)
+	}
+
 	sc.Git.staticReposBySlug = make(map[string]RepoConfig)
 
 	for _, repo := range sc.Git.Repos {
+		if strings.Contains(repo.Slug, "/") && !ValidSlug(repo.Slug) {
+			return fmt.Errorf("invalid namespaced slug %q for repo %s", repo.Slug, repo.Path)
+		}
+
+		if repo.VersionPattern != "" {
+			pattern, err := regexp.Compile(repo.VersionPattern)
+			if err != nil {
+				return fmt.Errorf("invalid version_pattern for repo %s: %w", repo.Path, err)
+			}
+			if pattern.NumSubexp() < 1 {
+				return fmt.Errorf("version_pattern for repo %s has no group for the version", repo.Path)
+			}
+		}
+
 		k := repo.Path
 		if repo.Slug != "" {
 			k = repo.Slug
@@ -95,7 +656,7 @@ func (sc *SmithyConfig) LoadAllRepositories() error {
 		sc.Git.staticReposBySlug[k] = repo
 	}
 
-	repos, err := ioutil.ReadDir(sc.Git.Root)
+	names, err := sc.discoverRepositories()
 
 	if err != nil {
 		return err
@@ -104,23 +665,17 @@ func (sc *SmithyConfig) LoadAllRepositories() error {
 	// TODO: should we clear out or not?
 	sc.Git.reposBySlug = make(map[string]RepositoryWithName)
 
-	for _, repo := range repos {
-		repoObj, exists := sc.findStaticRepo(repo.Name())
+	for name, r := range names {
+		repoObj, exists := sc.findStaticRepo(name)
 
 		if exists == true && repoObj.Exclude == true {
 			continue
 		}
 
-		repoPath := path.Join(sc.Git.Root, repo.Name())
+		repoPath := path.Join(sc.Git.Root, name)
 
-		r, err := git.PlainOpen(repoPath)
-		if err != nil {
-			// Ignore directories that aren't git repositories
-			continue
-		}
-
-		rwn := RepositoryWithName{Name: repo.Name(), Repository: r}
-		key := repo.Name()
+		rwn := RepositoryWithName{Name: name, Path: repoPath, Repository: r}
+		key := name
 
 		if exists {
 			rwn.Meta = repoObj
@@ -144,12 +699,12 @@ func (sc *SmithyConfig) LoadAllRepositories() error {
 			continue
 		}
 
-		r, err := git.PlainOpen(repo.Path)
+		r, err := sc.openRepository(repo.Path)
 		if err != nil {
 			// Ignore directories that aren't git repositories
 			continue
 		}
-		rwn := RepositoryWithName{Name: repo.Title, Repository: r, Meta: repo}
+		rwn := RepositoryWithName{Name: repo.Title, Path: repo.Path, Repository: r, Meta: repo}
 		key := repo.Path
 		if repo.Slug != "" {
 			key = repo.Slug
@@ -158,29 +713,173 @@ func (sc *SmithyConfig) LoadAllRepositories() error {
 		sc.Git.reposBySlug[key] = rwn
 	}
 
+	for key, rwn := range sc.Git.reposBySlug {
+		rwn.CloneURL = rwn.Meta.CloneURL
+		if rwn.CloneURL == "" {
+			rwn.CloneURL = sc.cloneURL(key)
+		}
+		rwn.SSHCloneURL = rwn.Meta.SSHCloneURL
+		if rwn.SSHCloneURL == "" {
+			rwn.SSHCloneURL = sc.sshCloneURL(key)
+		}
+		// Resolved once rather than on every request, it stays empty for
+		// repositories without any branch yet
+		if rwn.Meta.DefaultBranch == "" {
+			rwn.Meta.DefaultBranch = DefaultBranch(rwn.Repository, &RepoConfig{DefaultBranch: sc.DefaultBranch})
+		}
+		if rwn.Meta.VersionPattern != "" {
+			// The pattern was checked above
+			rwn.VersionPattern = regexp.MustCompile(rwn.Meta.VersionPattern)
+		}
+		sc.Git.reposBySlug[key] = rwn
+	}
+
+	sc.Git.loaded = true
+
 	return nil
 
 }
 
-func LoadConfig(path string) (SmithyConfig, error) {
-	var smithyConfig SmithyConfig
+// slugRegexp matches repository slugs, which may be namespaced, e.g.
+// org/repo
+var slugRegexp = regexp.MustCompile(`^` + RepoSlugPattern + `$`)
 
-	if path == "" {
-		path = "config.yaml"
+// ValidSlug reports whether slug can be routed to, namespaced or not
+func ValidSlug(slug string) bool {
+	if !slugRegexp.MatchString(slug) {
+		return false
 	}
 
-	contents, err := ioutil.ReadFile(path)
+	for _, segment := range strings.Split(slug, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverRepositories opens the repositories in the root directory, and
+// those one directory further down, which are namespaced by it, e.g.
+// org/repo.  They're returned by their path relative to the root.
+func (sc *SmithyConfig) discoverRepositories() (map[string]*git.Repository, error) {
+	dirs, err := ioutil.ReadDir(sc.Git.Root)
 
 	if err != nil {
-		return smithyConfig, err
+		return nil, err
 	}
 
-	err = yaml.Unmarshal(contents, &smithyConfig)
+	repos := map[string]*git.Repository{}
+	for _, dir := range dirs {
+		if r, err := sc.openRepository(path.Join(sc.Git.Root, dir.Name())); err == nil {
+			repos[dir.Name()] = r
+			continue
+		}
+
+		// Not a repository, maybe a namespace of them
+		subdirs, err := ioutil.ReadDir(path.Join(sc.Git.Root, dir.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, subdir := range subdirs {
+			name := path.Join(dir.Name(), subdir.Name())
+			if !ValidSlug(name) {
+				continue
+			}
+
+			// Ignore directories that aren't git repositories
+			if r, err := sc.openRepository(path.Join(sc.Git.Root, name)); err == nil {
+				repos[name] = r
+			}
+		}
+	}
+
+	return repos, nil
+}
+
+// cloneURL is the URL the repository with slug can be cloned from, it's empty
+// when HTTP cloning is turned off
+func (sc *SmithyConfig) cloneURL(slug string) string {
+	if !sc.Git.HTTPClone || sc.Host == "" {
+		return ""
+	}
+
+	scheme := "http"
+	if sc.ForceHTTPS {
+		scheme = "https"
+	}
+
+	return scheme + "://" + sc.Host + sc.Prefix + "/" + slug
+}
+
+// sshCloneURL is the scp-like URL the repository with slug can be cloned from
+// over SSH, it's empty when the host isn't known
+func (sc *SmithyConfig) sshCloneURL(slug string) string {
+	if sc.Host == "" {
+		return ""
+	}
+
+	host := sc.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return "git@" + host + ":" + slug
+}
+
+// Addr is the address smithy listens on, e.g. 127.0.0.1:3456
+func (sc *SmithyConfig) Addr() string {
+	return net.JoinHostPort(sc.ListenAddress, fmt.Sprint(sc.Port))
+}
+
+// Ready reports whether repositories have been loaded and there is at least
+// one to serve
+func (sc *SmithyConfig) Ready() bool {
+	return sc.Git.loaded && len(sc.Git.reposBySlug) > 0
+}
+
+// ResolvedRepo describes a repository smithy has discovered
+type ResolvedRepo struct {
+	Name string     `json:"name"`
+	Path string     `json:"path"`
+	Meta RepoConfig `json:"meta"`
+}
+
+// ResolvedConfig is the effective configuration once repositories have been
+// loaded
+type ResolvedConfig struct {
+	SmithyConfig `yaml:",inline"`
+	ReposBySlug  map[string]ResolvedRepo `yaml:"repos_by_slug" json:"repos_by_slug"`
+}
+
+func (sc *SmithyConfig) Resolved() ResolvedConfig {
+	resolved := ResolvedConfig{
+		SmithyConfig: *sc,
+		ReposBySlug:  make(map[string]ResolvedRepo),
+	}
+
+	for slug, repo := range sc.Git.reposBySlug {
+		resolved.ReposBySlug[slug] = ResolvedRepo{
+			Name: repo.Name,
+			Path: repo.Path,
+			Meta: repo.Meta,
+		}
+	}
+
+	return resolved
+}
+
+func LoadConfig(path string) (SmithyConfig, error) {
+	smithyConfig, errs, err := parseConfig(path)
 
 	if err != nil {
 		return smithyConfig, err
 	}
 
+	if len(errs) > 0 {
+		return smithyConfig, errs[0]
+	}
+
 	err = smithyConfig.LoadAllRepositories()
 
 	if err != nil {
@@ -190,15 +889,148 @@ func LoadConfig(path string) (SmithyConfig, error) {
 	return smithyConfig, nil
 }
 
+// parseConfig reads the configuration at path and checks its settings.
+// Unlike LoadConfig, it goes on past problems and returns all of them in
+// errs; err is only set when the file can't be read or parsed at all.
+// Repositories aren't loaded.
+func parseConfig(path string) (smithyConfig SmithyConfig, errs []error, err error) {
+	// Start from the defaults so that omitted keys keep sensible values,
+	// except host: without one, links and redirects use the request's
+	smithyConfig = New()
+	smithyConfig.Host = ""
+
+	if path == "" {
+		path = "config.yaml"
+	}
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return smithyConfig, nil, err
+	}
+
+	err = yaml.Unmarshal(contents, &smithyConfig)
+
+	// Values of the wrong type are left out, the rest is still decoded
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, msg := range typeErr.Errors {
+			errs = append(errs, errors.New(msg))
+		}
+	} else if err != nil {
+		return smithyConfig, nil, err
+	}
+
+	smithyConfig.Prefix = strings.TrimSuffix(smithyConfig.Prefix, "/")
+
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(smithyConfig.loadCustomCSS())
+	check(smithyConfig.loadCustomJS())
+	check(smithyConfig.compileLinkPatterns())
+	check(smithyConfig.compileRedirects())
+
+	switch smithyConfig.Tags.SortBy {
+	case TagSortName, TagSortDate, TagSortSemver:
+	default:
+		check(fmt.Errorf("invalid tag sort order %q, must be %s, %s or %s",
+			smithyConfig.Tags.SortBy, TagSortName, TagSortDate, TagSortSemver))
+	}
+
+	check(smithyConfig.TLS.validate(smithyConfig.Host))
+
+	switch smithyConfig.Log.Format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		check(fmt.Errorf("invalid log format %q, must be %s or %s",
+			smithyConfig.Log.Format, LogFormatText, LogFormatJSON))
+	}
+
+	if smithyConfig.Compression.Level < gzip.BestSpeed || smithyConfig.Compression.Level > gzip.BestCompression {
+		check(fmt.Errorf("invalid compression level %d, must be between %d and %d",
+			smithyConfig.Compression.Level, gzip.BestSpeed, gzip.BestCompression))
+	}
+
+	var cacheTTL time.Duration
+	if smithyConfig.Cache.TTL != "" {
+		cacheTTL, err = time.ParseDuration(smithyConfig.Cache.TTL)
+		if err != nil {
+			check(fmt.Errorf("invalid cache ttl: %w", err))
+		}
+	}
+	smithyConfig.renderCache = NewCache(smithyConfig.Cache.MaxEntries, cacheTTL)
+
+	if _, ok := styles.Registry[smithyConfig.Highlight.Style]; !ok {
+		fmt.Fprintf(os.Stderr, "Warning: unknown highlight style %q, using the fallback style\n", smithyConfig.Highlight.Style)
+	}
+
+	return smithyConfig, errs, nil
+}
+
 func New() SmithyConfig {
 	return SmithyConfig{
 		Title:       "Smithy, a lightweight git force",
 		Port:        3456,
 		Host:        "localhost",
 		Description: "Publish your git repositories with ease",
+		Git: GitConfig{
+			HTTPClone:       true,
+			ShortHashLength: DefaultShortHashLength,
+		},
 		Static: StaticConfig{
 			Prefix: "/static/",
 		},
+		Templates: TemplatesConfig{
+			Extensions: []string{".html"},
+			Cache:      TemplateCacheStartup,
+			TTL:        "1m",
+		},
+		Index: IndexConfig{
+			MaxBranchesShown: 10,
+			Layout:           IndexLayoutTable,
+			DefaultPageSize:  25,
+		},
+		Log: LogConfig{
+			MaxSubjectLength: 80,
+			Format:           LogFormatText,
+		},
+		Tags: TagsConfig{
+			SortBy: TagSortName,
+		},
+		Diff: DiffConfig{
+			ContextLines:     DefaultContextLines,
+			MaxContextLines:  100,
+			MaxFileDiffBytes: 65536,
+		},
+		Highlight: HighlightConfig{
+			Style: "autumn",
+		},
+		Blob: BlobConfig{
+			MaxSizeKB: 1024,
+		},
+		Cache: CacheConfig{
+			MaxEntries: 1000,
+		},
+		Compression: CompressionConfig{
+			Level:   DefaultCompressionLevel,
+			MinSize: 1024,
+		},
+		TLS: TLSConfig{
+			HTTP2: true,
+		},
+		MaxRequestBodyBytes: 32 << 20,
+	}
+}
+
+// ListHighlightStyles prints the names of the styles highlight.style can be
+// set to
+func ListHighlightStyles() {
+	for _, name := range styles.Names() {
+		fmt.Println(name)
 	}
 }
 
@@ -0,0 +1,215 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bufio"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// Kinds of dependencies
+const (
+	DependencyDirect   = "direct"
+	DependencyIndirect = "indirect"
+	DependencyDev      = "dev"
+	DependencyBuild    = "build"
+)
+
+// Dependency is a package a manifest such as go.mod depends on
+type Dependency struct {
+	Name    string
+	Version string
+	Kind    string
+}
+
+// ParseDependencies lists the dependencies declared in the manifest called
+// name.  It returns nil for files that aren't a known manifest.
+func ParseDependencies(name string, contents []byte) ([]Dependency, error) {
+	switch name {
+	case "go.mod":
+		return parseGoMod(contents)
+	case "package.json":
+		return parsePackageJSON(contents)
+	case "Cargo.toml":
+		return parseCargoToml(contents), nil
+	case "requirements.txt":
+		return parseRequirements(contents), nil
+	}
+	return nil, nil
+}
+
+func parseGoMod(contents []byte) ([]Dependency, error) {
+	f, err := modfile.ParseLax("go.mod", contents, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Dependency{}
+	for _, require := range f.Require {
+		kind := DependencyDirect
+		if require.Indirect {
+			kind = DependencyIndirect
+		}
+		results = append(results, Dependency{
+			Name:    require.Mod.Path,
+			Version: require.Mod.Version,
+			Kind:    kind,
+		})
+	}
+
+	return results, nil
+}
+
+func parsePackageJSON(contents []byte) ([]Dependency, error) {
+	var manifest struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, err
+	}
+
+	results := []Dependency{}
+	for _, section := range []struct {
+		deps map[string]string
+		kind string
+	}{
+		{manifest.Dependencies, DependencyDirect},
+		{manifest.DevDependencies, DependencyDev},
+	} {
+		var names []string
+		for name := range section.deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			results = append(results, Dependency{Name: name, Version: section.deps[name], Kind: section.kind})
+		}
+	}
+
+	return results, nil
+}
+
+// cargoSections maps the tables of Cargo.toml that list dependencies to
+// their kind
+var cargoSections = map[string]string{
+	"dependencies":       DependencyDirect,
+	"dev-dependencies":   DependencyDev,
+	"build-dependencies": DependencyBuild,
+}
+
+// parseCargoToml reads the `name = "version"` and `name = { version = ... }`
+// entries of the dependency tables, which covers the common manifests
+// without a full TOML parser
+func parseCargoToml(contents []byte) []Dependency {
+	results := []Dependency{}
+	kind := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			section := strings.Trim(line, "[] ")
+			// Platform specific tables look like [target.'cfg(unix)'.dependencies]
+			if i := strings.LastIndex(section, "."); i != -1 && strings.HasPrefix(section, "target.") {
+				section = section[i+1:]
+			}
+			kind = cargoSections[section]
+			continue
+		}
+
+		if kind == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.Trim(strings.TrimSpace(parts[0]), `"`)
+		value := strings.TrimSpace(parts[1])
+		version := ""
+
+		if strings.HasPrefix(value, "{") {
+			for _, field := range strings.Split(strings.Trim(value, "{}"), ",") {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) == 2 && strings.TrimSpace(kv[0]) == "version" {
+					version = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+			}
+		} else {
+			version = strings.Trim(value, `"`)
+		}
+
+		results = append(results, Dependency{Name: name, Version: version, Kind: kind})
+	}
+
+	return results
+}
+
+// requirementOperators separate a package from its version specifier in
+// requirements.txt, longest first
+var requirementOperators = []string{"===", "~=", "==", "!=", ">=", "<=", ">", "<"}
+
+func parseRequirements(contents []byte) []Dependency {
+	results := []Dependency{}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		// Options such as -r other.txt or --index-url aren't packages
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		if i := strings.Index(line, ";"); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		// The specifier starts at the first operator, e.g. in pkg<2,>=1
+		name, version := line, ""
+		start := len(line)
+		for _, operator := range requirementOperators {
+			if i := strings.Index(line, operator); i != -1 && i < start {
+				start = i
+			}
+		}
+		if start < len(line) {
+			name, version = strings.TrimSpace(line[:start]), strings.TrimSpace(line[start:])
+		}
+
+		results = append(results, Dependency{Name: name, Version: version, Kind: DependencyDirect})
+	}
+
+	return results
+}
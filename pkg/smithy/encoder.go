@@ -30,6 +30,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/format/diff"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // DefaultContextLines is the default number of context lines.
@@ -58,6 +59,13 @@ type UnifiedEncoder struct {
 	// contextLines is the count of unchanged lines that will appear surrounding
 	// a change.
 	contextLines int
+
+	// hashLength is how many characters of the hashes in index lines are
+	// shown, 0 shows them in full.
+	hashLength int
+
+	// wordDiff highlights the words that changed within changed lines.
+	wordDiff bool
 }
 
 // NewUnifiedEncoder returns a new UnifiedEncoder that writes to w.
@@ -68,6 +76,28 @@ func NewUnifiedEncoder(w io.Writer, contextLines int) *UnifiedEncoder {
 	}
 }
 
+// SetHashLength abbreviates the hashes in index lines to length characters.
+func (e *UnifiedEncoder) SetHashLength(length int) *UnifiedEncoder {
+	e.hashLength = length
+	return e
+}
+
+// SetWordDiff turns highlighting the words that changed within each pair of
+// deleted and added lines on or off.
+func (e *UnifiedEncoder) SetWordDiff(wordDiff bool) *UnifiedEncoder {
+	e.wordDiff = wordDiff
+	return e
+}
+
+// hash formats h for an index line.
+func (e *UnifiedEncoder) hash(h plumbing.Hash) string {
+	s := h.String()
+	if e.hashLength > 0 && e.hashLength < len(s) {
+		return s[:e.hashLength]
+	}
+	return s
+}
+
 // Encode encodes patch.
 func (e *UnifiedEncoder) Encode(patch object.Patch) error {
 	sb := &strings.Builder{}
@@ -83,7 +113,7 @@ func (e *UnifiedEncoder) Encode(patch object.Patch) error {
 		e.writeFilePatchHeader(sb, filePatch)
 		g := newHunksGenerator(filePatch.Chunks(), e.contextLines)
 		for _, hunk := range g.Generate() {
-			hunk.writeTo(sb)
+			hunk.writeTo(sb, e.wordDiff)
 		}
 	}
 
@@ -119,11 +149,11 @@ func (e *UnifiedEncoder) writeFilePatchHeader(sb *strings.Builder, filePatch dif
 		}
 		if from.Mode() != to.Mode() && !hashEquals {
 			lines = append(lines,
-				fmt.Sprintf("index %s..%s", from.Hash(), to.Hash()),
+				fmt.Sprintf("index %s..%s", e.hash(from.Hash()), e.hash(to.Hash())),
 			)
 		} else if !hashEquals {
 			lines = append(lines,
-				fmt.Sprintf("index %s..%s %o", from.Hash(), to.Hash(), from.Mode()),
+				fmt.Sprintf("index %s..%s %o", e.hash(from.Hash()), e.hash(to.Hash()), from.Mode()),
 			)
 		}
 		if !hashEquals {
@@ -133,14 +163,14 @@ func (e *UnifiedEncoder) writeFilePatchHeader(sb *strings.Builder, filePatch dif
 		lines = append(lines,
 			fmt.Sprintf("diff --git a/%s b/%s", to.Path(), to.Path()),
 			fmt.Sprintf("new file mode %o", to.Mode()),
-			fmt.Sprintf("index %s..%s", plumbing.ZeroHash, to.Hash()),
+			fmt.Sprintf("index %s..%s", e.hash(plumbing.ZeroHash), e.hash(to.Hash())),
 		)
 		lines = e.appendPathLines(lines, "/dev/null", "b/"+to.Path(), isBinary)
 	case to == nil:
 		lines = append(lines,
 			fmt.Sprintf("diff --git a/%s b/%s", from.Path(), from.Path()),
 			fmt.Sprintf("deleted file mode %o", from.Mode()),
-			fmt.Sprintf("index %s..%s", from.Hash(), plumbing.ZeroHash),
+			fmt.Sprintf("index %s..%s", e.hash(from.Hash()), e.hash(plumbing.ZeroHash)),
 		)
 		lines = e.appendPathLines(lines, "a/"+from.Path(), "/dev/null", isBinary)
 	}
@@ -165,6 +195,61 @@ func (e *UnifiedEncoder) appendPathLines(lines []string, fromPath, toPath string
 	)
 }
 
+// SideBySideEncoder encodes a diff into the provided Writer as an HTML table
+// with the old file on the left and the new file on the right.  Each side has
+// its own line numbers.
+type SideBySideEncoder struct {
+	io.Writer
+
+	// contextLines is the count of unchanged lines that will appear surrounding
+	// a change.
+	contextLines int
+
+	// hashLength is how many characters of the hashes in index lines are
+	// shown, 0 shows them in full.
+	hashLength int
+}
+
+// NewSideBySideEncoder returns a new SideBySideEncoder that writes to w.
+func NewSideBySideEncoder(w io.Writer, contextLines int) *SideBySideEncoder {
+	return &SideBySideEncoder{
+		Writer:       w,
+		contextLines: contextLines,
+	}
+}
+
+// SetHashLength abbreviates the hashes in index lines to length characters.
+func (e *SideBySideEncoder) SetHashLength(length int) *SideBySideEncoder {
+	e.hashLength = length
+	return e
+}
+
+// Encode encodes patch.
+func (e *SideBySideEncoder) Encode(patch object.Patch) error {
+	sb := &strings.Builder{}
+	headers := &UnifiedEncoder{hashLength: e.hashLength}
+
+	for _, filePatch := range patch.FilePatches() {
+		header := &strings.Builder{}
+		headers.writeFilePatchHeader(header, filePatch)
+
+		sb.WriteString("<table class=\"diff-split\">\n")
+		sb.WriteString("<tr><td colspan=\"4\" class=\"diff-header\">")
+		sb.WriteString(strings.TrimSuffix(esc(header.String()), "\n"))
+		sb.WriteString("</td></tr>\n")
+
+		g := newHunksGenerator(filePatch.Chunks(), e.contextLines)
+		for _, hunk := range g.Generate() {
+			hunk.writeSplitTo(sb)
+		}
+
+		sb.WriteString("</table>\n")
+	}
+
+	_, err := e.Write([]byte(sb.String()))
+	return err
+}
+
 type hunksGenerator struct {
 	fromLine, toLine            int
 	ctxLines                    int
@@ -311,7 +396,124 @@ type hunk struct {
 	ops       []*op
 }
 
-func (h *hunk) writeTo(sb *strings.Builder) {
+func (h *hunk) writeTo(sb *strings.Builder, wordDiff bool) {
+	h.writeHeaderTo(sb)
+	sb.WriteByte('\n')
+
+	if !wordDiff {
+		for _, op := range h.ops {
+			op.writeTo(sb, nil)
+		}
+		return
+	}
+
+	// Runs of deleted lines are paired up with the added lines that follow
+	// them, like in writeSplitTo
+	var deleted, added []*op
+
+	flush := func() {
+		words := make([][]diffmatchpatch.Diff, len(deleted))
+		for i := 0; i < len(deleted) && i < len(added); i++ {
+			words[i] = diffWords(deleted[i].text, added[i].text)
+		}
+
+		for i, o := range deleted {
+			o.writeTo(sb, words[i])
+		}
+		for i, o := range added {
+			if i < len(words) {
+				o.writeTo(sb, words[i])
+			} else {
+				o.writeTo(sb, nil)
+			}
+		}
+
+		deleted, added = nil, nil
+	}
+
+	for _, o := range h.ops {
+		switch o.t {
+		case diff.Delete:
+			if len(added) > 0 {
+				flush()
+			}
+			deleted = append(deleted, o)
+		case diff.Add:
+			added = append(added, o)
+		case diff.Equal:
+			flush()
+			o.writeTo(sb, nil)
+		}
+	}
+
+	flush()
+}
+
+// diffWords compares a deleted line with the added line that replaced it
+func diffWords(from, to string) []diffmatchpatch.Diff {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMain(strings.TrimSuffix(from, "\n"), strings.TrimSuffix(to, "\n"), false)
+	return dmp.DiffCleanupSemantic(diffs)
+}
+
+// writeSplitTo writes the hunk as table rows.  Runs of deleted lines are
+// paired up with the added lines that follow them; whichever side is shorter
+// is padded with blank cells.
+func (h *hunk) writeSplitTo(sb *strings.Builder) {
+	sb.WriteString("<tr><td colspan=\"4\" class=\"diff-hunk\">")
+	h.writeHeaderTo(sb)
+	sb.WriteString("</td></tr>\n")
+
+	fromLine, toLine := h.fromLine, h.toLine
+	var deleted, added []*op
+
+	flush := func() {
+		rows := len(deleted)
+		if len(added) > rows {
+			rows = len(added)
+		}
+
+		for i := 0; i < rows; i++ {
+			sb.WriteString("<tr>")
+			if i < len(deleted) {
+				deleted[i].writeCellTo(sb, fromLine)
+				fromLine++
+			} else {
+				writeEmptyCellTo(sb)
+			}
+			if i < len(added) {
+				added[i].writeCellTo(sb, toLine)
+				toLine++
+			} else {
+				writeEmptyCellTo(sb)
+			}
+			sb.WriteString("</tr>\n")
+		}
+
+		deleted, added = nil, nil
+	}
+
+	for _, o := range h.ops {
+		switch o.t {
+		case diff.Delete:
+			deleted = append(deleted, o)
+		case diff.Add:
+			added = append(added, o)
+		case diff.Equal:
+			flush()
+			sb.WriteString("<tr>")
+			o.writeCellTo(sb, fromLine)
+			o.writeCellTo(sb, toLine)
+			sb.WriteString("</tr>\n")
+			fromLine++
+			toLine++
+		}
+	}
+
+	flush()
+}
+
+func (h *hunk) writeHeaderTo(sb *strings.Builder) {
 	sb.WriteString("@@ -")
 
 	if h.fromCount == 1 {
@@ -336,15 +538,8 @@ func (h *hunk) writeTo(sb *strings.Builder) {
 
 	if h.ctxPrefix != "" {
 		sb.WriteByte(' ')
-		sb.WriteString(h.ctxPrefix)
-	}
-
-	sb.WriteByte('\n')
-
-	for _, op := range h.ops {
-		op.writeTo(sb)
+		sb.WriteString(esc(h.ctxPrefix))
 	}
-
 }
 
 func (h *hunk) AddOp(t diff.Operation, ss ...string) {
@@ -373,16 +568,57 @@ func esc(s string) string {
 	return html.EscapeString(s)
 }
 
-func (o *op) writeTo(sb *strings.Builder) {
+// writeTo writes the line, highlighting the changed words in words when
+// it's given
+func (o *op) writeTo(sb *strings.Builder, words []diffmatchpatch.Diff) {
 	sb.WriteString("<span class=\"")
 	sb.WriteString(operationClass[o.t])
 	sb.WriteString("\">")
 	sb.WriteByte(operationChar[o.t])
+	if words != nil {
+		writeWordsTo(sb, words, o.t)
+	} else {
+		sb.WriteString(strings.TrimSuffix(esc(o.text), "\n"))
+	}
+	if !strings.HasSuffix(o.text, "\n") {
+		sb.WriteString("\n\\ No newline at end of file")
+	}
+	sb.WriteString("</span>")
+	sb.WriteByte('\n')
+}
+
+// writeWordsTo writes the side of words that belongs to a line of type t
+func writeWordsTo(sb *strings.Builder, words []diffmatchpatch.Diff, t diff.Operation) {
+	for _, word := range words {
+		switch {
+		case word.Type == diffmatchpatch.DiffEqual:
+			sb.WriteString(esc(word.Text))
+		case word.Type == diffmatchpatch.DiffDelete && t == diff.Delete:
+			sb.WriteString("<span class=\"diff-word-del\">")
+			sb.WriteString(esc(word.Text))
+			sb.WriteString("</span>")
+		case word.Type == diffmatchpatch.DiffInsert && t == diff.Add:
+			sb.WriteString("<span class=\"diff-word-add\">")
+			sb.WriteString(esc(word.Text))
+			sb.WriteString("</span>")
+		}
+	}
+}
+
+func (o *op) writeCellTo(sb *strings.Builder, line int) {
+	sb.WriteString("<td class=\"diff-line-number\">")
+	sb.WriteString(strconv.Itoa(line))
+	sb.WriteString("</td><td class=\"")
+	sb.WriteString(operationClass[o.t])
+	sb.WriteString("\">")
 	if strings.HasSuffix(o.text, "\n") {
 		sb.WriteString(strings.TrimSuffix(esc(o.text), "\n"))
 	} else {
 		sb.WriteString(esc(o.text) + "\n\\ No newline at end of file")
 	}
-	sb.WriteString("</span>")
-	sb.WriteByte('\n')
+	sb.WriteString("</td>")
+}
+
+func writeEmptyCellTo(sb *strings.Builder) {
+	sb.WriteString("<td class=\"diff-line-number\"></td><td class=\"diff-empty\"></td>")
 }
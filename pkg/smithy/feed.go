@@ -0,0 +1,292 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// FEED_SIZE is how many commits a repository's feed contains
+const FEED_SIZE int = 20
+
+// Feed formats
+const (
+	FeedAtom = "atom"
+	FeedRSS  = "rss"
+)
+
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type AtomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type AtomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type AtomEntry struct {
+	Title    string        `xml:"title"`
+	ID       string        `xml:"id"`
+	Link     AtomLink      `xml:"link"`
+	Updated  string        `xml:"updated"`
+	Author   AtomAuthor    `xml:"author"`
+	Category *AtomCategory `xml:"category,omitempty"`
+	Content  AtomContent   `xml:"content"`
+}
+
+// AtomFeed is an Atom 1.0 feed, see RFC 4287
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []AtomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type RSSItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Creator     string `xml:"dc:creator"`
+	Description string `xml:"description"`
+}
+
+type RSSChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []RSSItem `xml:"item"`
+}
+
+// RSSFeed is an RSS 2.0 feed
+type RSSFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+var (
+	// feedStatsCache holds the diff stats of the commits last in each
+	// repository's feed, keyed by the repository's directory
+	feedStatsCache      = map[string]map[plumbing.Hash]DiffStats{}
+	feedStatsCacheMutex sync.Mutex
+)
+
+// feedDiffStats returns the diff stats of each of the commits of the feed
+// of the repository at path.  The stats of commits that were in the feed
+// before are reused, and only those of commits still in it are kept.
+func feedDiffStats(ctx context.Context, path string, commits []*object.Commit) ([]DiffStats, error) {
+	feedStatsCacheMutex.Lock()
+	cached := feedStatsCache[path]
+	feedStatsCacheMutex.Unlock()
+
+	current := map[plumbing.Hash]DiffStats{}
+	var results []DiffStats
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		stats, ok := cached[commit.Hash]
+		if !ok {
+			changes, err := GetChanges(commit)
+			if err != nil {
+				return nil, err
+			}
+			patches, err := ChangePatches(changes)
+			if err != nil {
+				return nil, err
+			}
+			stats = ComputeDiffStats(patches)
+		}
+
+		current[commit.Hash] = stats
+		results = append(results, stats)
+	}
+
+	feedStatsCacheMutex.Lock()
+	feedStatsCache[path] = current
+	feedStatsCacheMutex.Unlock()
+
+	return results, nil
+}
+
+// feedCommits returns the newest FEED_SIZE commits on the default branch,
+// and their diff stats when the feed includes them
+func feedCommits(ctx *gin.Context, config SmithyConfig, repo RepositoryWithName) (string, []*object.Commit, []DiffStats, error) {
+	branch, revision, err := findDefaultBranch(config, repo)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var commits []*object.Commit
+	var stats []DiffStats
+
+	err = config.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		cIter, err := repo.Repository.Log(&git.LogOptions{From: *revision, Order: git.LogOrderCommitterTime})
+		if err != nil {
+			return err
+		}
+		defer cIter.Close()
+
+		for i := 0; i < FEED_SIZE; i++ {
+			commit, err := cIter.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			commits = append(commits, commit)
+		}
+
+		if config.Feed.IncludeDiffStats {
+			stats, err = feedDiffStats(ctx, repo.Path, commits)
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return branch, commits, stats, nil
+}
+
+// FeedView publishes a repository's latest commits as an Atom or RSS feed.
+// encoding/xml replaces characters XML doesn't allow, so commit messages
+// can't break the feed.
+func FeedView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	format := urlParts[1]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	branch, commits, stats, err := feedCommits(ctx, smithyConfig, repo)
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	base := baseURL(ctx, smithyConfig)
+	repoURL := base + "/" + repoName
+	title := repoName + " commits on " + branch
+
+	if format == FeedRSS {
+		feed := RSSFeed{
+			Version: "2.0",
+			DC:      "http://purl.org/dc/elements/1.1/",
+			Channel: RSSChannel{
+				Title:       title,
+				Link:        repoURL,
+				Description: title,
+			},
+		}
+
+		for _, commit := range commits {
+			link := repoURL + "/commit/" + commit.Hash.String()
+			feed.Channel.Items = append(feed.Channel.Items, RSSItem{
+				Title:       strings.Split(commit.Message, "\n")[0],
+				Link:        link,
+				GUID:        link,
+				PubDate:     commit.Committer.When.Format(time.RFC1123Z),
+				Creator:     commit.Author.Name,
+				Description: commit.Message,
+			})
+		}
+
+		writeFeed(ctx, "application/rss+xml", feed)
+		return
+	}
+
+	feed := AtomFeed{
+		Title: title,
+		ID:    repoURL + "/log/" + branch,
+		Links: []AtomLink{
+			{Href: repoURL, Rel: "alternate"},
+			{Href: repoURL + "/feed.atom", Rel: "self"},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if len(commits) > 0 {
+		feed.Updated = commits[0].Committer.When.Format(time.RFC3339)
+	}
+
+	for i, commit := range commits {
+		link := repoURL + "/commit/" + commit.Hash.String()
+		entry := AtomEntry{
+			Title:   strings.Split(commit.Message, "\n")[0],
+			ID:      link,
+			Link:    AtomLink{Href: link},
+			Updated: commit.Committer.When.Format(time.RFC3339),
+			Author:  AtomAuthor{Name: commit.Author.Name, Email: commit.Author.Email},
+			Content: AtomContent{Type: "text", Body: commit.Message},
+		}
+		if stats != nil {
+			entry.Category = &AtomCategory{
+				Term:  fmt.Sprintf("files-changed:%d", stats[i].FilesChanged),
+				Label: stats[i].String(),
+			}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	writeFeed(ctx, "application/atom+xml", feed)
+}
+
+func writeFeed(ctx *gin.Context, contentType string, feed interface{}) {
+	ctx.Header("Content-Type", contentType+"; charset=utf-8")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.WriteString(xml.Header)
+	if err := xml.NewEncoder(ctx.Writer).Encode(feed); err != nil {
+		ctx.Error(err)
+	}
+}
@@ -0,0 +1,53 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// gitFlight lets concurrent requests that miss the same cache entry share
+// one git operation instead of each running their own
+var gitFlight singleflight.Group
+
+// shareGitOperation runs fn for the first caller with key.  Callers that
+// ask for the same key while it runs wait for it and get the same result.
+// fn is given the first caller's context, so when that caller goes away or
+// runs out of time the others run fn again rather than share its error.
+func shareGitOperation[T any](ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	for {
+		v, err, _ := gitFlight.Do(key, func() (interface{}, error) {
+			return fn(ctx)
+		})
+		if isContextError(err) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return v.(T), nil
+	}
+}
+
+// isContextError reports whether err comes from a context that is done
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,264 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// DefaultLanguageColor is used for languages missing from LanguageColors
+const DefaultLanguageColor = "#6c757d"
+
+// LanguageColors maps language names, as chroma knows them, to the colors
+// of their badges
+var LanguageColors = map[string]string{
+	"Bash":       "#89e051",
+	"C":          "#555555",
+	"C++":        "#f34b7d",
+	"C#":         "#178600",
+	"CSS":        "#563d7c",
+	"Clojure":    "#db5855",
+	"Elixir":     "#6e4a7e",
+	"Erlang":     "#b83998",
+	"Go":         "#00add8",
+	"HTML":       "#e34c26",
+	"Haskell":    "#5e5086",
+	"Java":       "#b07219",
+	"JavaScript": "#f1e05a",
+	"Kotlin":     "#a97bff",
+	"Lua":        "#000080",
+	"OCaml":      "#3be133",
+	"PHP":        "#4f5d95",
+	"Perl":       "#0298c3",
+	"Python":     "#3572a5",
+	"Ruby":       "#701516",
+	"Rust":       "#dea584",
+	"Scala":      "#c22d40",
+	"Swift":      "#ffac45",
+	"TypeScript": "#2b7489",
+}
+
+// LanguageColor returns the badge color of language
+func LanguageColor(language string) string {
+	if color, ok := LanguageColors[language]; ok {
+		return color
+	}
+	return DefaultLanguageColor
+}
+
+// Languages that say little about what a repository is written in
+var ignoredLanguages = map[string]bool{
+	"plaintext":        true,
+	"markdown":         true,
+	"YAML":             true,
+	"JSON":             true,
+	"TOML":             true,
+	"reStructuredText": true,
+}
+
+// cachedLanguage is the primary language of a repository along with the
+// HEAD and exclude patterns it was detected with
+type cachedLanguage struct {
+	key      string
+	language string
+}
+
+var (
+	// languageCache holds one language per repository directory, so that
+	// it doesn't grow as HEAD moves.  Repositories that aren't stored on
+	// disk aren't cached.
+	languageCache      = map[string]cachedLanguage{}
+	languageCacheMutex sync.Mutex
+
+	// languagePending holds the repositories DetectLanguages is detecting
+	// the language of, by their directory and cache key
+	languagePending = map[string]bool{}
+)
+
+// LanguageWorkers is how many languages DetectLanguages detects at once
+const LanguageWorkers = 4
+
+// languageWorkers limits DetectLanguages to LanguageWorkers across requests
+var languageWorkers = make(chan struct{}, LanguageWorkers)
+
+// IndexLanguageWait is how long the index waits for languages that aren't
+// cached yet
+const IndexLanguageWait = time.Second
+
+// DetectLanguages returns the primary languages of repos by name, waiting
+// at most wait for the ones that aren't cached.  Those are detected in the
+// background, LanguageWorkers at a time and each within the git timeout,
+// so that languages missing from one page are there on the next.
+func DetectLanguages(config SmithyConfig, repos []RepositoryWithName, wait time.Duration) map[string]string {
+	type detected struct {
+		name     string
+		language string
+	}
+
+	languages := map[string]string{}
+	results := make(chan detected, len(repos))
+	started := 0
+
+	for _, repo := range repos {
+		head, err := repo.Repository.Head()
+		if err != nil {
+			continue
+		}
+
+		path := repositoryPath(repo.Repository)
+		key := head.Hash().String() + ":" + excludeKey(config.Exclude.Patterns)
+
+		languageCacheMutex.Lock()
+		cached, ok := languageCache[path]
+		pending := languagePending[path+":"+key]
+		if !ok || cached.key != key {
+			languagePending[path+":"+key] = true
+		}
+		languageCacheMutex.Unlock()
+
+		if ok && cached.key == key {
+			languages[repo.Name] = cached.language
+			continue
+		}
+		// Another request is already detecting it
+		if pending {
+			continue
+		}
+
+		started++
+		go func(repo RepositoryWithName, pendingKey string) {
+			languageWorkers <- struct{}{}
+			defer func() {
+				<-languageWorkers
+				languageCacheMutex.Lock()
+				delete(languagePending, pendingKey)
+				languageCacheMutex.Unlock()
+			}()
+
+			var language string
+			err := config.WithGitTimeout(context.Background(), func(ctx context.Context) error {
+				var err error
+				language, err = DetectPrimaryLanguage(ctx, repo.Repository, config.Exclude.Patterns)
+				return err
+			})
+			if err != nil {
+				language = ""
+			}
+			results <- detected{repo.Name, language}
+		}(repo, path+":"+key)
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for ; started > 0; started-- {
+		select {
+		case result := <-results:
+			if result.language != "" {
+				languages[result.name] = result.language
+			}
+		case <-timeout.C:
+			return languages
+		}
+	}
+
+	return languages
+}
+
+// DetectPrimaryLanguage returns the language most files in HEAD are written
+// in, or an empty string when none is recognized.  Files matching any of
+// the exclude patterns aren't counted.  It gives up once ctx is done.
+func DetectPrimaryLanguage(ctx context.Context, r *git.Repository, exclude []string) (string, error) {
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+
+	path := repositoryPath(r)
+	key := head.Hash().String() + ":" + excludeKey(exclude)
+
+	languageCacheMutex.Lock()
+	cached, ok := languageCache[path]
+	languageCacheMutex.Unlock()
+	if ok && cached.key == key {
+		return cached.language, nil
+	}
+
+	return shareGitOperation(ctx, "language:"+path+":"+key, func(ctx context.Context) (string, error) {
+		language, err := detectLanguage(ctx, r, head.Hash(), exclude)
+		if err != nil || path == "" {
+			return language, err
+		}
+
+		languageCacheMutex.Lock()
+		languageCache[path] = cachedLanguage{key: key, language: language}
+		languageCacheMutex.Unlock()
+
+		return language, nil
+	})
+}
+
+// detectLanguage finds the primary language of the tree of head
+func detectLanguage(ctx context.Context, r *git.Repository, head plumbing.Hash, exclude []string) (string, error) {
+	var language string
+
+	commit, err := r.CommitObject(head)
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	counts := map[string]int{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if MatchesExcludePattern(f.Name, exclude) {
+			return ctx.Err()
+		}
+
+		lexer := lexers.Match(f.Name)
+		if lexer == nil {
+			return nil
+		}
+		name := lexer.Config().Name
+		if !ignoredLanguages[name] {
+			counts[name]++
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for name, count := range counts {
+		// Break ties by name so that the result doesn't change between runs
+		if count > counts[language] || (count == counts[language] && name < language) {
+			language = name
+		}
+	}
+
+	return language, nil
+}
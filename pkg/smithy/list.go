@@ -0,0 +1,124 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// RepoSummary is what `smithy list-repos` shows about a repository
+type RepoSummary struct {
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+	Path  string `json:"path"`
+
+	// LastCommitHash and LastCommitDate describe the tip of the default
+	// branch, they're empty for repositories without commits
+	LastCommitHash string     `json:"last_commit_hash"`
+	LastCommitDate *time.Time `json:"last_commit_date"`
+
+	BranchCount int `json:"branch_count"`
+	TagCount    int `json:"tag_count"`
+}
+
+// SummarizeRepository describes repo for `smithy list-repos`
+func SummarizeRepository(config *SmithyConfig, repo RepositoryWithName) (RepoSummary, error) {
+	summary := RepoSummary{
+		Slug:  repo.Slug(),
+		Title: repo.Meta.Title,
+		Path:  repo.Path,
+	}
+	if summary.Title == "" {
+		summary.Title = repo.Name
+	}
+
+	branches, err := ListBranches(repo.Repository)
+	if err != nil {
+		return summary, err
+	}
+	summary.BranchCount = len(branches)
+
+	tags, err := ListTags(repo.Repository)
+	if err != nil {
+		return summary, err
+	}
+	summary.TagCount = len(tags)
+
+	meta := repo.Meta
+	if meta.DefaultBranch == "" {
+		meta.DefaultBranch = config.DefaultBranch
+	}
+
+	branch := DefaultBranch(repo.Repository, &meta)
+	if branch == "" {
+		return summary, nil
+	}
+
+	hash, err := repo.Repository.ResolveRevision(plumbing.Revision(branch))
+	if err != nil {
+		return summary, fmt.Errorf("failed to find default branch %q: %w", branch, err)
+	}
+
+	commit, err := repo.Repository.CommitObject(*hash)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.LastCommitHash = commit.Hash.String()
+	summary.LastCommitDate = &commit.Committer.When
+
+	return summary, nil
+}
+
+// ListRepositories writes a summary of every repository to out, as a table
+// or as JSON
+func ListRepositories(config *SmithyConfig, asJSON bool, out io.Writer) error {
+	repos := config.GetRepositories()
+	summaries := []RepoSummary{}
+	for _, repo := range repos {
+		summary, err := SummarizeRepository(config, repo)
+		if err != nil {
+			return fmt.Errorf("%s: %w", repo.Slug(), err)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SLUG\tTITLE\tPATH\tLAST COMMIT\tDATE\tBRANCHES\tTAGS")
+	for i, summary := range summaries {
+		hash, date := "-", "-"
+		if summary.LastCommitDate != nil {
+			hash = ShortHash(repos[i].Repository, plumbing.NewHash(summary.LastCommitHash), config.Git.ShortHashLength)
+			date = summary.LastCommitDate.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", summary.Slug, summary.Title,
+			summary.Path, hash, date, summary.BranchCount, summary.TagCount)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats of the access log
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// RequestIDHeader carries the ID given to each request
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDMiddleware gives each request a random ID, which is sent back in
+// the X-Request-ID header and logged
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := newRequestID()
+		ctx.Set("request_id", id)
+		ctx.Header(RequestIDHeader, id)
+		ctx.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// accessLogEntry is a line of the structured access log
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	IP        string    `json:"ip"`
+	Repo      string    `json:"repo,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// NewStructuredLogger logs each request as a line of JSON to stdout
+func NewStructuredLogger() gin.HandlerFunc {
+	return newStructuredLogger(os.Stdout)
+}
+
+func newStructuredLogger(out io.Writer) gin.HandlerFunc {
+	var mu sync.Mutex
+
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		// Views may rewrite the path, e.g. to strip the API prefix
+		path := ctx.Request.URL.Path
+
+		ctx.Next()
+
+		entry := accessLogEntry{
+			Time:      start,
+			Method:    ctx.Request.Method,
+			Path:      path,
+			Status:    ctx.Writer.Status(),
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			IP:        ctx.ClientIP(),
+			Repo:      ctx.GetString("repo"),
+			RequestID: ctx.GetString("request_id"),
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		out.Write(append(line, '\n'))
+	}
+}
@@ -0,0 +1,92 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Git operations timed by GitOperationDuration
+const (
+	GitOperationLog   = "log"
+	GitOperationTree  = "tree"
+	GitOperationDiff  = "diff"
+	GitOperationBlame = "blame"
+	GitOperationStats = "stats"
+)
+
+// GitOperationDuration records how long views spend in go-git
+var GitOperationDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "smithy_git_operation_duration_seconds",
+		Help:    "Time spent in git operations, by operation and repository.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"operation", "repo"},
+)
+
+// ObserveGitOperation records that operation on repo took elapsed
+func ObserveGitOperation(operation, repo string, elapsed time.Duration) {
+	GitOperationDuration.WithLabelValues(operation, repo).Observe(elapsed.Seconds())
+}
+
+// MetricsPath is where the metrics are served when they're enabled
+const MetricsPath = "/metrics"
+
+// RequestsTotal counts the requests served
+var RequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smithy_requests_total",
+		Help: "Requests served, by repository, route and status.",
+	},
+	[]string{"repo", "route", "status"},
+)
+
+// RequestDuration records how long requests take to serve
+var RequestDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "smithy_request_duration_seconds",
+		Help:    "Time spent serving requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"route"},
+)
+
+// MetricsMiddleware records each request in RequestsTotal and
+// RequestDuration once it has been served.  Dispatch tells it the route and
+// repository.
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+
+		ctx.Next()
+
+		route := ctx.GetString("route")
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := strconv.Itoa(ctx.Writer.Status())
+		RequestsTotal.WithLabelValues(ctx.GetString("repo"), route, status).Inc()
+		RequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,98 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ParseQueryParams fills a copy of defaults from the request's query
+// parameters.  Fields are matched by their `query` tag and int fields can be
+// limited with `min` and `max` tags:
+//
+//	type params struct {
+//		PerPage int `query:"per_page" min:"1" max:"100"`
+//	}
+//
+// Invalid input is answered with the 400 page, or a JSON error for clients
+// that asked for JSON, callers only need to return.
+func ParseQueryParams[T any](ctx *gin.Context, defaults T) (T, error) {
+	params := defaults
+
+	value := reflect.ValueOf(&params).Elem()
+	if value.Kind() != reflect.Struct {
+		panic("ParseQueryParams needs a struct")
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := field.Tag.Get("query")
+		if name == "" {
+			continue
+		}
+
+		raw, ok := ctx.GetQuery(name)
+		if !ok {
+			continue
+		}
+
+		if err := setQueryParam(value.Field(i), field, name, raw); err != nil {
+			Http400WithMessage(ctx, err.Error())
+			ctx.Abort()
+			return defaults, err
+		}
+	}
+
+	return params, nil
+}
+
+func setQueryParam(value reflect.Value, field reflect.StructField, name, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", name)
+		}
+		value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		if min, ok := field.Tag.Lookup("min"); ok {
+			if limit, _ := strconv.Atoi(min); n < limit {
+				return fmt.Errorf("%s must be at least %d", name, limit)
+			}
+		}
+		if max, ok := field.Tag.Lookup("max"); ok {
+			if limit, _ := strconv.Atoi(max); n > limit {
+				return fmt.Errorf("%s must be at most %d", name, limit)
+			}
+		}
+		value.SetInt(int64(n))
+	default:
+		panic(fmt.Sprintf("unsupported query parameter type %s", value.Type()))
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/niklasfasching/go-org/org"
+)
+
+// RenderReadme formats the contents of the readme called name as HTML,
+// picking the renderer by its extension.  Files without a known extension
+// are taken to be Markdown.
+func RenderReadme(name, contents string, config MarkdownConfig) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".org":
+		return RenderOrgMode(contents)
+	default:
+		return FormatMarkdown(contents, config)
+	}
+}
+
+// RenderOrgMode formats an Org-mode document as HTML.  Like Markdown, raw
+// HTML in the document is left out, and so are included files.  Documents
+// that can't be rendered are shown as they are.
+func RenderOrgMode(contents string) string {
+	config := org.New()
+	config.Log = log.New(ioutil.Discard, "", 0)
+	// Documents can still ask for a table of contents with #+OPTIONS
+	config.DefaultSettings["OPTIONS"] = strings.Replace(config.DefaultSettings["OPTIONS"], "toc:t", "toc:nil", 1)
+	config.ReadFile = func(string) ([]byte, error) {
+		return nil, errors.New("including files is not supported")
+	}
+
+	writer := org.NewHTMLWriter()
+	writer.HighlightCodeBlock = highlightOrgCode
+	writer.ExtendingWriter = &orgHTMLWriter{writer}
+
+	out, err := config.Parse(strings.NewReader(contents), "").Write(writer)
+	if err != nil {
+		return "<pre>" + html.EscapeString(contents) + "</pre>"
+	}
+
+	return out
+}
+
+// orgHTMLWriter is an org.HTMLWriter that drops raw HTML
+type orgHTMLWriter struct {
+	*org.HTMLWriter
+}
+
+func (w *orgHTMLWriter) WriteBlock(b org.Block) {
+	if b.Name == "EXPORT" {
+		return
+	}
+	w.HTMLWriter.WriteBlock(b)
+}
+
+func (w *orgHTMLWriter) WriteInlineBlock(b org.InlineBlock) {
+	if b.Name == "export" {
+		return
+	}
+	w.HTMLWriter.WriteInlineBlock(b)
+}
+
+// WriteRegularLink writes links to the web, to email addresses and to
+// other files as usual.  Any other link, including javascript: ones and
+// #+LINK abbreviations, is written as its text alone.
+func (w *orgHTMLWriter) WriteRegularLink(l org.RegularLink) {
+	switch strings.ToLower(l.Protocol) {
+	case "", "file", "http", "https", "mailto":
+		w.HTMLWriter.WriteRegularLink(l)
+	default:
+		if l.Description != nil {
+			org.WriteNodes(w, l.Description...)
+		} else {
+			w.WriteString(html.EscapeString(l.URL))
+		}
+	}
+}
+
+func (w *orgHTMLWriter) WriteKeyword(k org.Keyword) {
+	if k.Key == "HTML" {
+		return
+	}
+	w.HTMLWriter.WriteKeyword(k)
+}
+
+// highlightOrgCode highlights the source blocks of Org-mode documents the
+// same way code in Markdown is
+func highlightOrgCode(source, lang string, inline bool) string {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return "<pre>" + html.EscapeString(source) + "</pre>"
+	}
+
+	iterator, err := lexer.Tokenise(nil, source)
+	if err != nil {
+		return "<pre>" + html.EscapeString(source) + "</pre>"
+	}
+
+	var buf bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true), chromahtml.PreventSurroundingPre(inline))
+	if err := formatter.Format(&buf, styles.Fallback, iterator); err != nil {
+		return "<pre>" + html.EscapeString(source) + "</pre>"
+	}
+
+	return buf.String()
+}
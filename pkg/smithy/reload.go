@@ -0,0 +1,114 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ConfigHolder keeps the configuration requests are served with, which can
+// be replaced while smithy runs
+type ConfigHolder struct {
+	mu     sync.RWMutex
+	config SmithyConfig
+
+	// updating serialises Update so that changes aren't lost
+	updating sync.Mutex
+
+	// listeners are told when the configuration is replaced
+	listeners []chan struct{}
+}
+
+func NewConfigHolder(config SmithyConfig) *ConfigHolder {
+	return &ConfigHolder{config: config}
+}
+
+// Get returns the current configuration
+func (h *ConfigHolder) Get() SmithyConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+// Set replaces the configuration for requests from now on
+func (h *ConfigHolder) Set(config SmithyConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+
+	for _, listener := range h.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+			// The listener hasn't caught up with the last change yet
+		}
+	}
+}
+
+// Changes returns a channel that receives a value whenever the
+// configuration is replaced.  Changes made before the last one was received
+// are only sent once.
+func (h *ConfigHolder) Changes() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	listener := make(chan struct{}, 1)
+	h.listeners = append(h.listeners, listener)
+	return listener
+}
+
+// Update replaces the configuration with the one fn derives from it.  Only
+// one update runs at a time, and requests keep using the old configuration
+// until fn returns.  When fn fails the configuration is left as it was.
+func (h *ConfigHolder) Update(fn func(SmithyConfig) (SmithyConfig, error)) error {
+	h.updating.Lock()
+	defer h.updating.Unlock()
+
+	config, err := fn(h.Get())
+	if err != nil {
+		return err
+	}
+
+	h.Set(config)
+	return nil
+}
+
+// ReloadOnSIGHUP replaces the configuration in holder with the one load
+// returns whenever smithy receives SIGHUP.  When loading fails the old
+// configuration is kept.
+func ReloadOnSIGHUP(holder *ConfigHolder, load func() (SmithyConfig, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := holder.Update(func(SmithyConfig) (SmithyConfig, error) {
+				return load()
+			})
+			if err != nil {
+				fmt.Println("Failed to reload the configuration, keeping the old one:", err)
+				continue
+			}
+
+			fmt.Println("Reloaded the configuration")
+		}
+	}()
+}
@@ -0,0 +1,216 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Default, shortest and longest abbreviated hash length
+const (
+	DefaultShortHashLength = 8
+	MinShortHashLength     = 4
+	MaxShortHashLength     = 40
+)
+
+// commitHashList is the sorted hashes of every commit in a repository,
+// listed while its refs were as refs digests them
+type commitHashList struct {
+	refs   string
+	hashes []plumbing.Hash
+}
+
+var (
+	// commitHashCache holds one list per repository directory, it's
+	// replaced once the repository's refs move
+	commitHashCache      = map[string]commitHashList{}
+	commitHashCacheMutex sync.Mutex
+)
+
+// repositoryPath returns the directory r is stored in, or an empty string
+// when it's held in memory
+func repositoryPath(r *git.Repository) string {
+	if storage, ok := r.Storer.(*filesystem.Storage); ok {
+		return storage.Filesystem().Root()
+	}
+	return ""
+}
+
+// refsDigest sums up the refs of r, it changes whenever one of them moves
+func refsDigest(r *git.Repository) (string, error) {
+	refs, err := r.References()
+	if err != nil {
+		return "", err
+	}
+
+	var values []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		values = append(values, ref.Name().String(), ref.Target().String(), ref.Hash().String())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hashETag(values...), nil
+}
+
+// commitHashes returns the sorted hashes of every commit in r.  They're
+// cached for each repository until one of its refs moves.
+func commitHashes(r *git.Repository) ([]plumbing.Hash, error) {
+	path := repositoryPath(r)
+	if path == "" {
+		return loadCommitHashes(r)
+	}
+
+	refs, err := refsDigest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	commitHashCacheMutex.Lock()
+	cached, ok := commitHashCache[path]
+	commitHashCacheMutex.Unlock()
+	if ok && cached.refs == refs {
+		return cached.hashes, nil
+	}
+
+	// The list is kept even when the request that asked for it is gone,
+	// so its walk isn't cut short
+	return shareGitOperation(context.Background(), "hashes:"+path+":"+refs, func(context.Context) ([]plumbing.Hash, error) {
+		hashes, err := loadCommitHashes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		commitHashCacheMutex.Lock()
+		commitHashCache[path] = commitHashList{refs: refs, hashes: hashes}
+		commitHashCacheMutex.Unlock()
+
+		return hashes, nil
+	})
+}
+
+// loadCommitHashes lists the sorted hashes of every commit in r
+func loadCommitHashes(r *git.Repository) ([]plumbing.Hash, error) {
+	var hashes []plumbing.Hash
+
+	iter, err := r.CommitObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		hashes = append(hashes, c.Hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+
+	return hashes, nil
+}
+
+// SafeShortHash abbreviates hash to length characters, or more when another
+// of the sorted hashes starts with the same characters
+func SafeShortHash(hashes []plumbing.Hash, hash plumbing.Hash, length int) string {
+	full := hash.String()
+
+	// Only the neighbours of hash in sorted order can share a longer prefix
+	i := sort.Search(len(hashes), func(i int) bool {
+		return bytes.Compare(hashes[i][:], hash[:]) >= 0
+	})
+
+	for _, j := range []int{i - 1, i, i + 1} {
+		if j < 0 || j >= len(hashes) || hashes[j] == hash {
+			continue
+		}
+
+		other := hashes[j].String()
+		for length < len(full) && full[:length] == other[:length] {
+			length++
+		}
+	}
+
+	if length > len(full) {
+		length = len(full)
+	}
+
+	return full[:length]
+}
+
+// ShortHash abbreviates the hash of a commit in r to at least length
+// characters, making sure that it's unambiguous
+func ShortHash(r *git.Repository, hash plumbing.Hash, length int) string {
+	hashes, err := commitHashes(r)
+	if err != nil {
+		hashes = nil
+	}
+
+	return SafeShortHash(hashes, hash, length)
+}
+
+// ErrAmbiguousHash is returned when more than one commit starts with a short
+// hash
+var ErrAmbiguousHash = errors.New("ambiguous short hash")
+
+// ResolveShortHash finds the commit in r whose hash starts with prefix.
+// Only commit hashes are matched, never branches or tags that happen to be
+// named like one.
+func ResolveShortHash(r *git.Repository, prefix string) (plumbing.Hash, error) {
+	prefix = strings.ToLower(prefix)
+
+	hashes, err := commitHashes(r)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return findHashPrefix(hashes, prefix)
+}
+
+// findHashPrefix returns the only one of the sorted hashes that starts with
+// prefix
+func findHashPrefix(hashes []plumbing.Hash, prefix string) (plumbing.Hash, error) {
+	// Hex strings sort the same way as the bytes they stand for
+	i := sort.Search(len(hashes), func(i int) bool {
+		return hashes[i].String() >= prefix
+	})
+
+	if i == len(hashes) || !strings.HasPrefix(hashes[i].String(), prefix) {
+		return plumbing.ZeroHash, plumbing.ErrObjectNotFound
+	}
+
+	if i+1 < len(hashes) && strings.HasPrefix(hashes[i+1].String(), prefix) {
+		return plumbing.ZeroHash, ErrAmbiguousHash
+	}
+
+	return hashes[i], nil
+}
@@ -0,0 +1,179 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// KeyServerURL is where the keys of signed commits are looked up
+const KeyServerURL = "https://keys.openpgp.org/search?q="
+
+// Tags of the OpenPGP packets and signature subpackets read here, see RFC
+// 4880
+const (
+	pgpSignaturePacket            = 2
+	pgpIssuerSubpacket            = 16
+	pgpIssuerFingerprintSubpacket = 33
+)
+
+var errNoIssuer = errors.New("signature doesn't name its key")
+
+// ExtractPGPKeyID returns the ID of the key that made an ASCII armored PGP
+// signature, such as a commit's, as 16 hex digits.  Only the signature's
+// packets are read, so that keys of any algorithm work.
+func ExtractPGPKeyID(signature string) (string, error) {
+	block, err := armor.Decode(strings.NewReader(signature))
+	if err != nil {
+		return "", err
+	}
+
+	if block.Type != openpgp.SignatureType {
+		return "", fmt.Errorf("not a PGP signature but a %s", block.Type)
+	}
+
+	packets := packet.NewOpaqueReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return "", errors.New("no signature packet found")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if p.Tag != pgpSignaturePacket {
+			continue
+		}
+
+		keyID, err := signatureIssuer(p.Contents)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%016X", keyID), nil
+	}
+}
+
+// PGPKeyURL links to the key with keyID on KeyServerURL
+func PGPKeyURL(keyID string) string {
+	return KeyServerURL + keyID
+}
+
+// signatureIssuer reads the key ID from the body of a signature packet
+func signatureIssuer(contents []byte) (uint64, error) {
+	if len(contents) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	switch contents[0] {
+	case 3:
+		// Version, length of the hashed material, type and creation time
+		// come before the key ID
+		if len(contents) < 15 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return binary.BigEndian.Uint64(contents[7:15]), nil
+	case 4:
+		// Version, type and algorithms come before the hashed and then the
+		// unhashed subpackets, either can name the key
+		rest := contents[4:]
+		var fromFingerprint uint64
+		for i := 0; i < 2; i++ {
+			if len(rest) < 2 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			length := int(binary.BigEndian.Uint16(rest))
+			rest = rest[2:]
+			if len(rest) < length {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			keyID, fingerprint, err := subpacketsIssuer(rest[:length])
+			if err != nil {
+				return 0, err
+			}
+			if keyID != 0 {
+				return keyID, nil
+			}
+			if fromFingerprint == 0 {
+				fromFingerprint = fingerprint
+			}
+			rest = rest[length:]
+		}
+
+		if fromFingerprint != 0 {
+			return fromFingerprint, nil
+		}
+		return 0, errNoIssuer
+	default:
+		return 0, fmt.Errorf("unsupported signature version %d", contents[0])
+	}
+}
+
+// subpacketsIssuer returns the key ID of the issuer subpacket and the one
+// derived from the issuer fingerprint subpacket, either is 0 when missing
+func subpacketsIssuer(subpackets []byte) (keyID, fromFingerprint uint64, err error) {
+	for len(subpackets) > 0 {
+		var length int
+		switch first := subpackets[0]; {
+		case first < 192:
+			length, subpackets = int(first), subpackets[1:]
+		case first < 255:
+			if len(subpackets) < 2 {
+				return 0, 0, io.ErrUnexpectedEOF
+			}
+			length = (int(first)-192)<<8 + int(subpackets[1]) + 192
+			subpackets = subpackets[2:]
+		default:
+			if len(subpackets) < 5 {
+				return 0, 0, io.ErrUnexpectedEOF
+			}
+			length = int(binary.BigEndian.Uint32(subpackets[1:5]))
+			subpackets = subpackets[5:]
+		}
+
+		if length == 0 || len(subpackets) < length {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+
+		// The high bit marks critical subpackets
+		body := subpackets[1:length]
+		switch subpackets[0] & 0x7f {
+		case pgpIssuerSubpacket:
+			if len(body) == 8 {
+				keyID = binary.BigEndian.Uint64(body)
+			}
+		case pgpIssuerFingerprintSubpacket:
+			// A version 4 fingerprint ends with the key ID
+			if len(body) == 21 && body[0] == 4 {
+				fromFingerprint = binary.BigEndian.Uint64(body[13:])
+			}
+		}
+
+		subpackets = subpackets[length:]
+	}
+
+	return keyID, fromFingerprint, nil
+}
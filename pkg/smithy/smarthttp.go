@@ -0,0 +1,160 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadPackService is the only smart HTTP service smithy serves; pushing
+// isn't supported
+const UploadPackService = "git-upload-pack"
+
+// pktLine encodes s as a git pkt-line
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// uploadPackCommand runs `git upload-pack` on the repository in path,
+// finding its git directory the way OpenRepositoryWithEnv does
+func uploadPackCommand(ctx *gin.Context, path string, args ...string) *exec.Cmd {
+	if gitDir, ok := gitDirFromEnv(path); ok {
+		path = gitDir
+	}
+
+	args = append([]string{"upload-pack", "--stateless-rpc"}, args...)
+	args = append(args, path)
+	cmd := exec.CommandContext(ctx.Request.Context(), "git", args...)
+
+	// git would take GIT_DIR relative to smithy's working directory
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "GIT_DIR=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+
+	return cmd
+}
+
+// findCloneRepo looks up the repository for a smart HTTP request, returning
+// false when it doesn't exist or HTTP cloning is turned off
+func findCloneRepo(ctx *gin.Context, repoName string) (RepositoryWithName, bool) {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	if !smithyConfig.Git.HTTPClone {
+		return RepositoryWithName{}, false
+	}
+
+	return smithyConfig.FindRepo(repoName)
+}
+
+// InfoRefsView advertises a repository's refs to a cloning git client
+func InfoRefsView(ctx *gin.Context, urlParts []string) {
+	repo, exists := findCloneRepo(ctx, urlParts[0])
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	if ctx.Query("service") != UploadPackService {
+		ctx.String(http.StatusForbidden, "only the smart HTTP %s service is supported", UploadPackService)
+		return
+	}
+
+	refs, err := uploadPackCommand(ctx, repo.Path, "--advertise-refs").Output()
+	if err != nil {
+		Http500(ctx)
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Content-Type", "application/x-git-upload-pack-advertisement")
+	ctx.Status(http.StatusOK)
+	io.WriteString(ctx.Writer, pktLine("# service="+UploadPackService+"\n"))
+	io.WriteString(ctx.Writer, "0000")
+	ctx.Writer.Write(refs)
+}
+
+// UploadPackView sends a git client the pack it negotiated for
+func UploadPackView(ctx *gin.Context, urlParts []string) {
+	repo, exists := findCloneRepo(ctx, urlParts[0])
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	if ctx.Request.Method != http.MethodPost {
+		ctx.String(http.StatusMethodNotAllowed, "%s must be POSTed", UploadPackService)
+		return
+	}
+
+	var body io.Reader = ctx.Request.Body
+	if ctx.GetHeader("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			if !requestBodyTooLarge(ctx) {
+				ctx.String(http.StatusBadRequest, "invalid gzip request body")
+			}
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+
+	// The whole request is read before git sees any of it, so that one cut
+	// off at max_request_body_bytes is refused rather than half answered
+	request, err := ioutil.ReadAll(body)
+	if err != nil {
+		if !requestBodyTooLarge(ctx) {
+			ctx.String(http.StatusBadRequest, "invalid request body")
+		}
+		return
+	}
+
+	cmd := uploadPackCommand(ctx, repo.Path)
+	cmd.Stdin = bytes.NewReader(request)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		Http500(ctx)
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		Http500(ctx)
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Content-Type", "application/x-git-upload-pack-result")
+	ctx.Status(http.StatusOK)
+	io.Copy(ctx.Writer, stdout)
+
+	// The response has already been sent, there's nothing to report a
+	// failure to
+	cmd.Wait()
+}
@@ -18,29 +18,51 @@ package smithy
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/alecthomas/chroma/formatters/html"
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/alecthomas/chroma/styles"
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/gin-gonic/gin"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/yuin/goldmark"
 	highlighting "github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/mod/semver"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 
 	"embed"
 
@@ -57,14 +79,93 @@ const PAGE_SIZE int = 100
 
 type RepositoryWithName struct {
 	Name       string
+	Path       string
 	Repository *git.Repository
 	Meta       RepoConfig
+
+	// CloneURL is the smart HTTP URL of the repository, empty when HTTP
+	// cloning is turned off
+	CloneURL string
+	// SSHCloneURL is the URL the repository can be cloned from over SSH
+	SSHCloneURL string
+	// VersionPattern is Meta.VersionPattern compiled, nil when there's none
+	VersionPattern *regexp.Regexp
+}
+
+// Slug is the part of the repository's URLs that names it
+func (r RepositoryWithName) Slug() string {
+	if r.Meta.Slug != "" {
+		return r.Meta.Slug
+	}
+	return r.Name
+}
+
+// DisplayName is the repository's title, or its slug when it has none.
+// With showSlug, a title is followed by the slug when they differ, e.g.
+// "My Project (myproject)".
+func (r RepositoryWithName) DisplayName(showSlug bool) string {
+	if r.Meta.Title == "" {
+		return r.Slug()
+	}
+	if showSlug && r.Meta.Title != r.Slug() {
+		return fmt.Sprintf("%s (%s)", r.Meta.Title, r.Slug())
+	}
+	return r.Meta.Title
+}
+
+// Namespace is the part of a namespaced slug before the repository's own
+// name, e.g. org for org/repo, and empty for other slugs
+func (r RepositoryWithName) Namespace() string {
+	if dir := path.Dir(r.Slug()); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// LastSynced is when the repository was last fetched into, which is when a
+// mirror was last updated.  It's zero when it has never been fetched.
+func (r RepositoryWithName) LastSynced() time.Time {
+	synced, _ := LastFetched(r.Repository)
+	return synced
+}
+
+// GroupByNamespace groups repos by their namespace
+func GroupByNamespace(repos []RepositoryWithName) map[string][]RepositoryWithName {
+	groups := map[string][]RepositoryWithName{}
+	for _, repo := range repos {
+		groups[repo.Namespace()] = append(groups[repo.Namespace()], repo)
+	}
+	return groups
 }
 
 type Commit struct {
-	Commit    *object.Commit
-	Subject   string
-	ShortHash string
+	Commit       *object.Commit
+	Subject      string
+	ShortSubject string
+	ShortHash    string
+}
+
+// NewCommit wraps commit, a commit in r, for the templates
+func NewCommit(r *git.Repository, commit *object.Commit, maxSubjectLength, shortHashLength int) Commit {
+	subject := strings.Split(commit.Message, "\n")[0]
+
+	return Commit{
+		Commit:       commit,
+		Subject:      subject,
+		ShortSubject: TruncateSubject(subject, maxSubjectLength),
+		ShortHash:    ShortHash(r, commit.Hash, shortHashLength),
+	}
+}
+
+// TruncateSubject cuts subject down to maxLen characters, marking the cut
+// with an ellipsis.  A maxLen of 0 leaves the subject alone.
+func TruncateSubject(subject string, maxLen int) string {
+	runes := []rune(subject)
+	if maxLen <= 0 || len(runes) <= maxLen {
+		return subject
+	}
+
+	return strings.TrimRight(string(runes[:maxLen]), " ") + "…"
 }
 
 func (c *Commit) FormattedDate() string {
@@ -72,10 +173,109 @@ func (c *Commit) FormattedDate() string {
 	// return c.Commit.Author.When.Format(time.RFC822)
 }
 
+// GraphNode is a commit in the JSON representation of the history graph
+type GraphNode struct {
+	Hash    string    `json:"hash"`
+	Parents []string  `json:"parents"`
+	Subject string    `json:"subject"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+}
+
+// Ancestor is a commit in the JSON list of a commit's first-parent ancestors
+type Ancestor struct {
+	Hash    string    `json:"hash"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+}
+
+func ConvertGraphNodes(commits []Commit) []GraphNode {
+	results := []GraphNode{}
+
+	for _, c := range commits {
+		parents := []string{}
+		for _, parent := range c.Commit.ParentHashes {
+			parents = append(parents, parent.String())
+		}
+
+		results = append(results, GraphNode{
+			Hash:    c.Commit.Hash.String(),
+			Parents: parents,
+			Subject: c.Subject,
+			Author:  c.Commit.Author.Name,
+			Date:    c.Commit.Committer.When,
+		})
+	}
+
+	return results
+}
+
+// firstParentIter walks the history by following only the first parent of
+// each commit, like `git log --first-parent`.  It stops at the commits in
+// missing, the cut off of a shallow clone.
+type firstParentIter struct {
+	next    *object.Commit
+	missing map[plumbing.Hash]bool
+}
+
+func NewFirstParentIter(commit *object.Commit, missing map[plumbing.Hash]bool) object.CommitIter {
+	return &firstParentIter{next: commit, missing: missing}
+}
+
+func (it *firstParentIter) Next() (*object.Commit, error) {
+	if it.next == nil {
+		return nil, io.EOF
+	}
+
+	commit := it.next
+	it.next = nil
+
+	if commit.NumParents() > 0 && !it.missing[commit.ParentHashes[0]] {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		it.next = parent
+	}
+
+	return commit, nil
+}
+
+func (it *firstParentIter) ForEach(cb func(*object.Commit) error) error {
+	for {
+		commit, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := cb(commit); err != nil {
+			if err == storer.ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (it *firstParentIter) Close() {
+	it.next = nil
+}
+
 type TreeEntry struct {
 	Name string
 	Mode filemode.FileMode
 	Hash plumbing.Hash
+
+	// LastModified is the latest commit that touched the entry, it's only
+	// looked up when tree.show_last_modified is set
+	LastModified *Commit
+
+	// IsSymlink is set for symbolic links, SymlinkTarget is the path they
+	// point at once ResolveSymlinks has run
+	IsSymlink     bool
+	SymlinkTarget string
 }
 
 func (te *TreeEntry) FileMode() string {
@@ -91,14 +291,43 @@ func (te *TreeEntry) FileMode() string {
 	return osFile.String()
 }
 
+// IsDotFile reports whether the entry is hidden by convention
+func (te *TreeEntry) IsDotFile() bool {
+	return strings.HasPrefix(te.Name, ".")
+}
+
+// IsSubmodule reports whether the entry points at a commit in another
+// repository
+func (te *TreeEntry) IsSubmodule() bool {
+	return te.Mode == filemode.Submodule
+}
+
+// FilterTreeEntries returns the entries predicate holds for
+func FilterTreeEntries(entries []TreeEntry, predicate func(TreeEntry) bool) []TreeEntry {
+	var results []TreeEntry
+
+	for _, entry := range entries {
+		if predicate(entry) {
+			results = append(results, entry)
+		}
+	}
+
+	return results
+}
+
+func isVisibleTreeEntry(entry TreeEntry) bool {
+	return !entry.IsDotFile()
+}
+
 func ConvertTreeEntries(entries []object.TreeEntry) []TreeEntry {
 	var results []TreeEntry
 
 	for _, entry := range entries {
 		e := TreeEntry{
-			Name: entry.Name,
-			Mode: entry.Mode,
-			Hash: entry.Hash,
+			Name:      entry.Name,
+			Mode:      entry.Mode,
+			Hash:      entry.Hash,
+			IsSymlink: entry.Mode == filemode.Symlink,
 		}
 		results = append(results, e)
 	}
@@ -106,6 +335,267 @@ func ConvertTreeEntries(entries []object.TreeEntry) []TreeEntry {
 	return results
 }
 
+// ResolveSymlinks sets the target of the symbolic links among the entries
+// of tree.  Git stores the target as the contents of the link's blob.
+// Targets that can't be read, e.g. in shallow clones, are left empty.
+func ResolveSymlinks(tree *object.Tree, entries []TreeEntry) {
+	for i, entry := range entries {
+		if !entry.IsSymlink {
+			continue
+		}
+
+		f, err := tree.TreeEntryFile(&object.TreeEntry{Name: entry.Name, Mode: entry.Mode, Hash: entry.Hash})
+		if err != nil {
+			continue
+		}
+
+		target, err := f.Contents()
+		if err != nil {
+			continue
+		}
+		entries[i].SymlinkTarget = target
+	}
+}
+
+// SetLastModified looks up the latest commit, starting at from, that
+// touched each of the entries of the directory dir.  The history is walked
+// once for all of them, until ctx is done.
+func SetLastModified(ctx context.Context, r *git.Repository, from plumbing.Hash, dir string, entries []TreeEntry, shortHashLength int) error {
+	commit, err := r.CommitObject(from)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, path.Join(dir, entry.Name))
+	}
+
+	byPath, err := GetLastCommitForPaths(ctx, commit, paths)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if c, ok := byPath[path.Join(dir, entry.Name)]; ok {
+			lastModified := NewCommit(r, c, 0, shortHashLength)
+			entries[i].LastModified = &lastModified
+		}
+	}
+
+	return nil
+}
+
+// GetLastCommitForPaths walks the history of commit once and returns the
+// latest commit that changed each of paths.  Paths that didn't change since
+// the start of the history are mapped to the oldest commit.  The walk stops
+// with ctx's error once it's done.
+func GetLastCommitForPaths(ctx context.Context, commit *object.Commit, paths []string) (map[string]*object.Commit, error) {
+	results := map[string]*object.Commit{}
+	remaining := map[string]bool{}
+	for _, p := range paths {
+		remaining[p] = true
+	}
+
+	entryHash := func(tree *object.Tree, p string) plumbing.Hash {
+		entry, err := tree.FindEntry(p)
+		if err != nil {
+			return plumbing.ZeroHash
+		}
+		return entry.Hash
+	}
+
+	cIter := object.NewCommitIterCTime(commit, nil, nil)
+	defer cIter.Close()
+
+	// The history of shallow clones ends with missing objects
+	for len(remaining) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		c, err := cIter.Next()
+		if err == io.EOF || err == plumbing.ErrObjectNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+
+		var parentTrees []*object.Tree
+		err = c.Parents().ForEach(func(parent *object.Commit) error {
+			parentTree, err := parent.Tree()
+			if err != nil {
+				return err
+			}
+			parentTrees = append(parentTrees, parentTree)
+			return nil
+		})
+		if err != nil && err != plumbing.ErrObjectNotFound {
+			return nil, err
+		}
+
+		for p := range remaining {
+			hash := entryHash(tree, p)
+
+			// A path that is the same as in one of the parents came from
+			// that parent
+			unchanged := false
+			for _, parentTree := range parentTrees {
+				if entryHash(parentTree, p) == hash {
+					unchanged = true
+					break
+				}
+			}
+
+			if !unchanged {
+				results[p] = c
+				delete(remaining, p)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// ChangedFile is a path touched by a commit
+type ChangedFile struct {
+	Path       string
+	Deleted    bool
+	Insertions int
+	Deletions  int
+}
+
+// FileStat counts the lines added and removed by one change
+type FileStat struct {
+	Insertions int
+	Deletions  int
+}
+
+// DiffStats summarises a diff like the last line of `git diff --stat`
+type DiffStats struct {
+	FilesChanged int
+	Insertions   int
+	Deletions    int
+
+	// Files holds the stat of each change, in the same order as the changes
+	Files []FileStat
+}
+
+// countLines counts the lines in a chunk of a patch, including a last line
+// without a trailing newline
+func countLines(content string) int {
+	lines := strings.Count(content, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// ChangePatches computes the patch of each of the changes, in the same
+// order, so that they can be counted and formatted without diffing the
+// files again
+func ChangePatches(changes object.Changes) ([]*object.Patch, error) {
+	var patches []*object.Patch
+	for _, change := range changes {
+		patch, err := change.Patch()
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
+
+// ComputeDiffStats counts the files changed and the lines inserted and
+// deleted by the patches of a set of changes. Binary files count as changed
+// with no lines.
+func ComputeDiffStats(patches []*object.Patch) DiffStats {
+	stats := DiffStats{FilesChanged: len(patches)}
+
+	for _, patch := range patches {
+		var stat FileStat
+
+		for _, fp := range patch.FilePatches() {
+			if fp.IsBinary() {
+				continue
+			}
+
+			for _, chunk := range fp.Chunks() {
+				switch chunk.Type() {
+				case diff.Add:
+					stat.Insertions += countLines(chunk.Content())
+				case diff.Delete:
+					stat.Deletions += countLines(chunk.Content())
+				}
+			}
+		}
+
+		stats.Insertions += stat.Insertions
+		stats.Deletions += stat.Deletions
+		stats.Files = append(stats.Files, stat)
+	}
+
+	return stats
+}
+
+// String formats the stats like `git diff --stat` does
+func (s DiffStats) String() string {
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+
+	return fmt.Sprintf("%s changed, %s(+), %s(-)",
+		plural(s.FilesChanged, "file"), plural(s.Insertions, "insertion"), plural(s.Deletions, "deletion"))
+}
+
+// ConvertChangedFilesWithStats is ConvertChangedFiles with each file's
+// insertions and deletions filled in from stats
+func ConvertChangedFilesWithStats(changes object.Changes, stats DiffStats) []ChangedFile {
+	files := ConvertChangedFiles(changes)
+	for i := range files {
+		if i < len(stats.Files) {
+			files[i].Insertions = stats.Files[i].Insertions
+			files[i].Deletions = stats.Files[i].Deletions
+		}
+	}
+	return files
+}
+
+func ConvertChangedFiles(changes object.Changes) []ChangedFile {
+	var results []ChangedFile
+
+	for _, change := range changes {
+		if change.To.Name == "" {
+			results = append(results, ChangedFile{Path: change.From.Name, Deleted: true})
+			continue
+		}
+		results = append(results, ChangedFile{Path: change.To.Name})
+	}
+
+	return results
+}
+
+// TreeLink returns the URL of the tree view for a file or a directory
+func TreeLink(repoName, refName, treePath string) string {
+	link := "/" + repoName + "/tree/" + refName
+
+	treePath = strings.Trim(treePath, "/")
+	if treePath != "" {
+		link += "/" + treePath
+	}
+
+	return link
+}
+
 type RepositoryByName []RepositoryWithName
 
 func (r RepositoryByName) Len() int      { return len(r) }
@@ -135,6 +625,31 @@ func PathExists(path string) (bool, error) {
 	return false, err
 }
 
+// MatchesExcludePattern reports whether path matches any of patterns.
+// Patterns without a slash are matched against the file name alone, so that
+// "*.min.js" matches in every directory.
+func MatchesExcludePattern(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		name := path
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(path)
+		}
+
+		matched, err := doublestar.Match(pattern, name)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludeKey identifies a set of exclude patterns in cache keys, so that
+// results computed with other patterns aren't reused
+func excludeKey(patterns []string) string {
+	return hashETag(patterns...)
+}
+
 func DefaultParam(ctx *gin.Context, key, def string) string {
 	p := ctx.Param(key)
 
@@ -145,6 +660,21 @@ func DefaultParam(ctx *gin.Context, key, def string) string {
 	return def
 }
 
+// findRootFile returns the first of names found at the root of commit's
+// tree, or an error mentioning what was looked for
+func findRootFile(commit *object.Commit, names []string, what string) (*object.File, error) {
+	for _, name := range names {
+		f, err := commit.File(name)
+
+		if err == nil {
+			return f, nil
+		}
+
+	}
+
+	return nil, errors.New("no valid " + what)
+}
+
 func GetReadmeFromCommit(commit *object.Commit) (*object.File, error) {
 	options := []string{
 		"README.md",
@@ -153,23 +683,113 @@ func GetReadmeFromCommit(commit *object.Commit) (*object.File, error) {
 		"readme.md",
 		"readme.markdown",
 		"readme",
+		"README.org",
+		"readme.org",
+	}
+
+	return findRootFile(commit, options, "readme")
+}
+
+// Names license files go by, in order of preference
+var licenseFileNames = []string{
+	"LICENSE",
+	"LICENSE.md",
+	"LICENSE.txt",
+	"LICENCE",
+	"LICENCE.md",
+	"LICENCE.txt",
+	"COPYING",
+	"COPYING.md",
+	"COPYING.txt",
+	"license",
+	"license.md",
+	"license.txt",
+}
+
+// IsLicenseFile reports whether name is one of the names license files go
+// by
+func IsLicenseFile(name string) bool {
+	for _, n := range licenseFileNames {
+		if n == name {
+			return true
+		}
 	}
+	return false
+}
+
+func GetLicenseFromCommit(commit *object.Commit) (*object.File, error) {
+	return findRootFile(commit, licenseFileNames, "license")
+}
 
-	for _, opt := range options {
-		f, err := commit.File(opt)
+func GetChangelogFromCommit(commit *object.Commit) (*object.File, error) {
+	options := []string{
+		"CHANGELOG.md",
+		"CHANGELOG",
+		"CHANGELOG.txt",
+		"CHANGES.md",
+		"CHANGES",
+		"NEWS.md",
+		"NEWS",
+		"HISTORY.md",
+		"changelog.md",
+		"changelog",
+	}
+
+	return findRootFile(commit, options, "changelog")
+}
 
-		if err == nil {
-			return f, nil
+func GetContributorsFromCommit(commit *object.Commit) (*object.File, error) {
+	options := []string{
+		"CONTRIBUTORS",
+		"CONTRIBUTORS.md",
+		"CONTRIBUTORS.txt",
+		"AUTHORS",
+		"AUTHORS.md",
+		"AUTHORS.txt",
+	}
+
+	return findRootFile(commit, options, "contributors file")
+}
+
+// VersionScanDepth is how many recent commits are searched for a release
+const VersionScanDepth = 100
+
+// FindLatestRelease returns the first group of pattern in the subject of the
+// newest of the last VersionScanDepth commits up to commit that matches it,
+// or an empty string
+func FindLatestRelease(commit *object.Commit, pattern *regexp.Regexp) (string, error) {
+	iter := object.NewCommitIterCTime(commit, nil, nil)
+	defer iter.Close()
+
+	for i := 0; i < VersionScanDepth; i++ {
+		c, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
 		}
 
+		subject := strings.SplitN(c.Message, "\n", 2)[0]
+		if match := pattern.FindStringSubmatch(subject); match != nil && len(match) > 1 {
+			return ReleaseVersion(match[1]), nil
+		}
 	}
 
-	return nil, errors.New("no valid readme")
+	return "", nil
+}
+
+// ReleaseVersion adds the customary v to version numbers, e.g. 1.2.3
+func ReleaseVersion(version string) string {
+	if version != "" && version[0] >= '0' && version[0] <= '9' {
+		return "v" + version
+	}
+	return version
 }
 
-func FormatMarkdown(input string) string {
+func FormatMarkdown(input string, config MarkdownConfig) string {
 	var buf bytes.Buffer
-	markdown := goldmark.New(
+	options := []goldmark.Option{
 		goldmark.WithExtensions(
 			highlighting.NewHighlighting(
 				highlighting.WithFormatOptions(
@@ -177,37 +797,191 @@ func FormatMarkdown(input string) string {
 				),
 			),
 		),
-	)
+	}
+
+	// The table of contents links to the headings by their ID
+	if config.GenerateTOC {
+		options = append(options, goldmark.WithParserOptions(parser.WithAutoHeadingID()))
+	}
+
+	markdown := goldmark.New(options...)
 
-	if err := markdown.Convert([]byte(input), &buf); err != nil {
+	source := []byte(input)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
 		panic(err)
 	}
 
+	if config.GenerateTOC {
+		return TableOfContents(doc, source) + buf.String()
+	}
+
 	return buf.String()
 
 }
 
-func RenderSyntaxHighlighting(file *object.File) (string, error) {
-	contents, err := file.Contents()
-	if err != nil {
-		return "", err
-	}
-	lexer := lexers.Match(file.Name)
-	if lexer == nil {
-		// If the lexer is nil, we weren't able to find one based on the file
-		// extension.  We can render it as plain text.
-		return fmt.Sprintf("<pre>%s</pre>", contents), nil
-	}
+// tocEntry is a heading listed in a table of contents
+type tocEntry struct {
+	level int
+	id    string
+	text  string
+}
 
-	style := styles.Get("autumn")
+// TableOfContents renders a nav linking to the second and third level
+// headings of doc, or nothing when it has none
+func TableOfContents(doc ast.Node, source []byte) string {
+	var entries []tocEntry
 
-	if style == nil {
-		style = styles.Fallback
-	}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
 
-	formatter := html.New(
-		html.WithClasses(true),
-		html.WithLineNumbers(true),
+		if heading.Level == 2 || heading.Level == 3 {
+			id, _ := heading.AttributeString("id")
+			idBytes, _ := id.([]byte)
+			entries = append(entries, tocEntry{
+				level: heading.Level,
+				id:    string(idBytes),
+				text:  string(heading.Text(source)),
+			})
+		}
+		return ast.WalkSkipChildren, nil
+	})
+
+	if len(entries) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<nav class="toc"><ul>`)
+
+	// Third level headings are nested below the second level heading
+	// before them
+	nested := false
+	for i, entry := range entries {
+		switch {
+		case entry.level == 3 && !nested && i > 0:
+			sb.WriteString("<ul>")
+			nested = true
+		case entry.level == 2 && nested:
+			sb.WriteString("</li></ul></li>")
+			nested = false
+		case i > 0:
+			sb.WriteString("</li>")
+		}
+
+		fmt.Fprintf(&sb, `<li><a href="#%s">%s</a>`,
+			template.HTMLEscapeString(entry.id), template.HTMLEscapeString(entry.text))
+	}
+
+	if nested {
+		sb.WriteString("</li></ul>")
+	}
+	sb.WriteString("</li></ul></nav>")
+
+	return sb.String()
+}
+
+// DetectAndConvertEncoding guesses the character encoding of content and
+// returns its name along with the content converted to UTF-8.  Content that
+// looks binary is returned unchanged.
+func DetectAndConvertEncoding(content []byte) (string, string, error) {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xff, 0xfe}), bytes.HasPrefix(content, []byte{0xfe, 0xff}):
+		decoder := unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder()
+		converted, err := decoder.Bytes(content)
+		if err != nil {
+			return "", "", err
+		}
+		return "UTF-16", string(converted), nil
+	case utf8.Valid(content):
+		return "UTF-8", string(content), nil
+	case bytes.IndexByte(content, 0) != -1:
+		return "binary", string(content), nil
+	}
+
+	converted, err := charmap.ISO8859_1.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", "", err
+	}
+	return "ISO-8859-1", string(converted), nil
+}
+
+// CopyButton renders a button that copies text to the clipboard.  The
+// footer's script handles clicks, inline handlers don't pass the
+// Content-Security-Policy.
+func CopyButton(text string) template.HTML {
+	return template.HTML(fmt.Sprintf(
+		`<button type="button" class="btn btn-sm btn-outline-secondary copy" data-copy="%s">Copy</button>`,
+		template.HTMLEscapeString(text)))
+}
+
+// Linkify escapes text and turns the parts of it that match patterns into
+// links.  Where matches overlap the earliest one, then the first pattern,
+// wins.
+func Linkify(text string, patterns []LinkPattern) template.HTML {
+	type match struct {
+		start, end int
+		href       string
+		label      string
+	}
+
+	var matches []match
+	for _, pattern := range patterns {
+		if pattern.regex == nil {
+			continue
+		}
+		for _, loc := range pattern.regex.FindAllStringSubmatchIndex(text, -1) {
+			href := pattern.regex.ExpandString(nil, pattern.URL, text, loc)
+			matches = append(matches, match{loc[0], loc[1], string(href), pattern.Label})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+
+	var buf strings.Builder
+	pos := 0
+	for _, m := range matches {
+		if m.start < pos || m.start == m.end {
+			continue
+		}
+		buf.WriteString(template.HTMLEscapeString(text[pos:m.start]))
+		buf.WriteString(`<a href="` + template.HTMLEscapeString(m.href) + `"`)
+		if m.label != "" {
+			buf.WriteString(` title="` + template.HTMLEscapeString(m.label) + `"`)
+		}
+		buf.WriteString(">" + template.HTMLEscapeString(text[m.start:m.end]) + "</a>")
+		pos = m.end
+	}
+	buf.WriteString(template.HTMLEscapeString(text[pos:]))
+
+	return template.HTML(buf.String())
+}
+
+// RenderPlainText renders contents without any highlighting
+func RenderPlainText(contents string) string {
+	return fmt.Sprintf("<pre>%s</pre>", template.HTMLEscapeString(contents))
+}
+
+func RenderSyntaxHighlighting(name, contents string, config HighlightConfig) (string, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		// If the lexer is nil, we weren't able to find one based on the file
+		// extension.  We can render it as plain text.
+		return RenderPlainText(contents), nil
+	}
+
+	// Unknown styles get the fallback, LoadConfig warns about them
+	style := styles.Get(config.Style)
+
+	formatter := html.New(
+		html.WithClasses(!config.InlineCSS),
+		html.WithLineNumbers(true),
 		html.LineNumbersInTable(true),
 		html.LinkableLineNumbers(true, "L"),
 	)
@@ -218,30 +992,117 @@ func RenderSyntaxHighlighting(file *object.File) (string, error) {
 	err = formatter.Format(buf, style, iterator)
 
 	if err != nil {
-		return fmt.Sprintf("<pre>%s</pre>", contents), nil
+		return RenderPlainText(contents), nil
 	}
 
 	return buf.String(), nil
 }
 
+// StatusClientClosedRequest is logged for requests whose client went away
+// before they were answered, like nginx does
+const StatusClientClosedRequest = 499
+
+// clientGone reports whether the client stopped waiting for the response,
+// aborting the request if so, so that views can give up on expensive work
+// nobody will see
+func clientGone(ctx *gin.Context) bool {
+	if ctx.Request.Context().Err() == nil {
+		return false
+	}
+
+	ctx.AbortWithStatus(StatusClientClosedRequest)
+	return true
+}
+
 func Http404(ctx *gin.Context) {
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
-	ctx.HTML(http.StatusNotFound, "404.html", makeTemplateContext(smithyConfig, gin.H{}))
+	respondWithStatus(ctx, http.StatusNotFound, "404.html", makeTemplateContext(ctx, smithyConfig, gin.H{}))
+}
+
+// Http404WithMessage renders the 404 page with an explanation of what
+// couldn't be found
+func Http404WithMessage(ctx *gin.Context, msg string) {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	respondWithStatus(ctx, http.StatusNotFound, "404.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"Error": msg,
+	}))
+}
+
+// Http400WithMessage renders the 400 page with an explanation of what was
+// wrong with the request
+func Http400WithMessage(ctx *gin.Context, msg string) {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	respondWithStatus(ctx, http.StatusBadRequest, "400.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"Error": msg,
+	}))
 }
 
 func Http500(ctx *gin.Context) {
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
-	ctx.HTML(http.StatusInternalServerError, "500.html",
-		makeTemplateContext(smithyConfig, gin.H{}))
+	respondWithStatus(ctx, http.StatusInternalServerError, "500.html",
+		makeTemplateContext(ctx, smithyConfig, gin.H{}))
+}
+
+// urlPrefix returns what goes in front of paths smithy redirects to, so
+// that API clients stay within the API
+func urlPrefix(ctx *gin.Context, config SmithyConfig) string {
+	if ctx.GetBool("api") {
+		return config.Prefix + APIv1Prefix
+	}
+	return config.Prefix
+}
+
+// requestScheme returns the scheme the client used to reach smithy, taking
+// TLS-terminating proxies into account
+func requestScheme(ctx *gin.Context) string {
+	if proto := ctx.GetHeader("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+
+	if ctx.Request.TLS != nil {
+		return "https"
+	}
+
+	return "http"
 }
 
-func makeTemplateContext(config SmithyConfig, extra gin.H) gin.H {
+// baseURL returns the absolute URL smithy is served at
+func baseURL(ctx *gin.Context, config SmithyConfig) string {
+	return requestScheme(ctx) + "://" + config.Host + config.Prefix
+}
+
+// BaseContext returns the template values every page has access to
+func BaseContext(ctx *gin.Context, config SmithyConfig) gin.H {
 	results := gin.H{
-		"Site": gin.H{
-			"Title":       config.Title,
-			"Description": config.Description,
-			"Host":        config.Host,
-		},
+		"BaseURL":    baseURL(ctx, config),
+		"CurrentURL": config.Prefix + ctx.Request.URL.String(),
+		"Title":      config.Title,
+		"User":       nil,
+		"CustomCSS":  config.customCSS,
+		"CustomJS":   config.customJS,
+	}
+
+	if user, exists := ctx.Get("user"); exists {
+		results["User"] = user
+	}
+
+	if token, exists := ctx.Get("csrf_token"); exists {
+		results["CSRFToken"] = token
+	}
+
+	if nonce, exists := ctx.Get("csp_nonce"); exists {
+		results["Nonce"] = nonce
+	}
+
+	return results
+}
+
+func makeTemplateContext(ctx *gin.Context, config SmithyConfig, extra gin.H) gin.H {
+	results := BaseContext(ctx, config)
+	results["Site"] = gin.H{
+		"Title":       config.Title,
+		"Description": config.Description,
+		"Host":        config.Host,
 	}
 	for k, v := range extra {
 		results[k] = v
@@ -249,24 +1110,227 @@ func makeTemplateContext(config SmithyConfig, extra gin.H) gin.H {
 	return results
 }
 
+// LivenessView answers as long as the process is able to serve requests
+func LivenessView(ctx *gin.Context, urlParts []string) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadinessView answers only once there are repositories to serve
+func ReadinessView(ctx *gin.Context, urlParts []string) {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	if !smithyConfig.Ready() {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// AdminCacheFlushView empties the cache of rendered READMEs and diffs.  It
+// takes the admin secret as a bearer token, and doesn't exist without one.
+func AdminCacheFlushView(ctx *gin.Context, urlParts []string) {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	if smithyConfig.Admin.Secret == "" {
+		Http404(ctx)
+		return
+	}
+
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(smithyConfig.Admin.Secret)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin secret"})
+		return
+	}
+
+	flushed := smithyConfig.renderCache.Flush()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "flushed": flushed})
+}
+
+// Index page layouts
+const (
+	// Aligned columns of names and descriptions
+	IndexLayoutTable = "table"
+	// A card with the description for every repository
+	IndexLayoutCard = "card"
+	// A single-column list of names
+	IndexLayoutCompact = "compact"
+)
+
+// MaxPageSize is the largest number of repositories listed on one page
+const MaxPageSize = 500
+
+type indexParams struct {
+	Page int `query:"page" min:"1"`
+	// Keep max in sync with MaxPageSize
+	PerPage int `query:"per_page" min:"1" max:"500"`
+}
+
 func IndexView(ctx *gin.Context, urlParts []string) {
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
-	repos := smithyConfig.GetRepositories()
 
-	ctx.HTML(http.StatusOK, "index.html", makeTemplateContext(smithyConfig, gin.H{
-		"Repos": repos,
+	defaultPerPage := smithyConfig.Index.DefaultPageSize
+	if defaultPerPage < 1 || defaultPerPage > MaxPageSize {
+		defaultPerPage = MaxPageSize
+	}
+
+	params, err := ParseQueryParams(ctx, indexParams{Page: 1, PerPage: defaultPerPage})
+	if err != nil {
+		return
+	}
+	page, perPage := params.Page, params.PerPage
+
+	repos, total := smithyConfig.GetRepositoriesPage(page, perPage)
+	pageCount := (total + perPage - 1) / perPage
+
+	languages := DetectLanguages(smithyConfig, repos, IndexLanguageWait)
+
+	RespondWith(ctx, "index.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"Repos":     repos,
+		"Groups":    GroupByNamespace(repos),
+		"Languages": languages,
+		"Layout":    smithyConfig.Index.Layout,
+		"ShowSlug":  smithyConfig.Index.ShowSlug,
+		"Page":      page,
+		"PerPage":   perPage,
+		"PageCount": pageCount,
+		"PrevPage":  page - 1,
+		"NextPage":  page + 1,
+		"HasPrev":   page > 1,
+		"HasNext":   page < pageCount,
 	}))
 }
 
-func findMainBranch(ctx *gin.Context, repo *git.Repository) (string, *plumbing.Hash, error) {
+// findLanguage returns the primary language of repo, or an empty string
+// when it can't be detected in time
+func findLanguage(ctx *gin.Context, config SmithyConfig, repo RepositoryWithName) string {
+	var language string
+
+	err := config.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		language, err = DetectPrimaryLanguage(ctx, repo.Repository, config.Exclude.Patterns)
+		return err
+	})
+
+	if err != nil {
+		ctx.Error(err)
+		return ""
+	}
+
+	return language
+}
+
+// IsShallowRepository reports whether r was cloned with --depth, so that
+// its history is cut off
+func IsShallowRepository(r *git.Repository) bool {
+	commits, err := r.Storer.Shallow()
+	return err == nil && len(commits) > 0
+}
+
+// LastFetched returns when git fetch last wrote FETCH_HEAD in r
+func LastFetched(r *git.Repository) (time.Time, error) {
+	storage, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return time.Time{}, errors.New("repository isn't stored on disk")
+	}
+
+	info, err := storage.Filesystem().Stat("FETCH_HEAD")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// UpstreamURL turns the upstream of a fork or mirror, which may leave out the
+// scheme, e.g. example.com/original, into a URL
+func UpstreamURL(upstream string) string {
+	if strings.Contains(upstream, "://") {
+		return upstream
+	}
+	return "https://" + upstream
+}
+
+// missingParents returns the parents of a shallow clone's oldest commits,
+// which aren't in the repository
+func missingParents(r *git.Repository) (map[plumbing.Hash]bool, error) {
+	shallow, err := r.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	missing := map[plumbing.Hash]bool{}
+	for _, hash := range shallow {
+		commit, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.ParentHashes {
+			missing[parent] = true
+		}
+	}
+
+	return missing, nil
+}
+
+// NewShallowLogIter walks the history of a shallow clone by committer time,
+// like r.Log, but stops at the cut off instead of failing on the missing
+// parents of its oldest commits
+func NewShallowLogIter(r *git.Repository, from plumbing.Hash) (object.CommitIter, error) {
+	missing, err := missingParents(r)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := r.CommitObject(from)
+	if err != nil {
+		return nil, err
+	}
+
+	return object.NewCommitIterCTime(commit, missing, nil), nil
+}
+
+// DefaultBranch returns the branch shown when no ref is given: the configured
+// one, then the branch HEAD points at and finally a 'main' or 'master'
+// branch.  It's empty when none of them exist.
+func DefaultBranch(r *git.Repository, config *RepoConfig) string {
+	if config != nil && config.DefaultBranch != "" {
+		return config.DefaultBranch
+	}
+
+	head, err := r.Head()
+	if err == nil && head.Name().IsBranch() {
+		return head.Name().Short()
+	}
+
 	for _, candidate := range []string{"main", "master"} {
-		revision, err := repo.ResolveRevision(plumbing.Revision(candidate))
-		if err == nil {
-			return candidate, revision, nil
+		if _, err := r.Reference(plumbing.NewBranchReferenceName(candidate), true); err == nil {
+			return candidate
 		}
-		ctx.Error(err)
 	}
-	return "", nil, fmt.Errorf("failed to find a 'main' or 'master' branch")
+
+	return ""
+}
+
+// findDefaultBranch resolves the branch shown when no ref is given.  That's
+// usually the one found when the repository was loaded, it's only looked
+// for again when the repository had no branches then.
+func findDefaultBranch(config SmithyConfig, repo RepositoryWithName) (string, *plumbing.Hash, error) {
+	meta := repo.Meta
+	if meta.DefaultBranch == "" {
+		meta.DefaultBranch = config.DefaultBranch
+	}
+
+	branch := DefaultBranch(repo.Repository, &meta)
+	if branch == "" {
+		return "", nil, fmt.Errorf("failed to find a 'main' or 'master' branch")
+	}
+
+	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(branch))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find default branch %q: %w", branch, err)
+	}
+	return branch, revision, nil
 }
 
 func RepoIndexView(ctx *gin.Context, urlParts []string) {
@@ -287,43 +1351,100 @@ func RepoIndexView(ctx *gin.Context, urlParts []string) {
 		return
 	}
 
-	ts, err := ListTags(repo.Repository)
+	ts, err := ListTagsSortedBy(repo.Repository, smithyConfig.Tags.SortBy)
 	if err != nil {
 		Http500(ctx)
 		return
 	}
 
 	var formattedReadme string
+	var docsRef string
+	var defaultBranch string
+	var licenseName, changelogName, contributorsName string
+	var latestRelease string
+	var releaseErr error
+
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		branch, revision, err := findDefaultBranch(smithyConfig, repo)
+		if err != nil {
+			return nil
+		}
+		defaultBranch = branch
 
-	_, revision, err := findMainBranch(ctx, repo.Repository)
-
-	if err == nil {
 		commitObj, err := repo.Repository.CommitObject(*revision)
+		if err != nil {
+			return nil
+		}
 
-		if err == nil {
+		if tree, err := commitObj.Tree(); err == nil {
+			if _, err := tree.Tree(repo.Meta.Docs()); err == nil {
+				docsRef = branch
+			}
+		}
 
-			readme, err := GetReadmeFromCommit(commitObj)
+		if license, err := GetLicenseFromCommit(commitObj); err == nil {
+			licenseName = license.Name
+		}
 
-			if err != nil {
-				formattedReadme = ""
-			} else {
-				readmeContents, err := readme.Contents()
+		if changelog, err := GetChangelogFromCommit(commitObj); err == nil {
+			changelogName = changelog.Name
+		}
 
-				if err != nil {
-					formattedReadme = ""
-				} else {
-					formattedReadme = FormatMarkdown(readmeContents)
-				}
+		if contributors, err := GetContributorsFromCommit(commitObj); err == nil {
+			contributorsName = contributors.Name
+		}
+
+		if repo.VersionPattern != nil {
+			latestRelease, releaseErr = FindLatestRelease(commitObj, repo.VersionPattern)
+		}
+
+		readme, err := GetReadmeFromCommit(commitObj)
+		if err != nil {
+			return nil
+		}
+
+		key := fmt.Sprintf("readme:%s:%s:%s", repo.Slug(), readme.Name, readme.Hash)
+		formattedReadme, err = smithyConfig.renderCache.GetOrRender(key, func() (string, error) {
+			readmeContents, err := readme.Contents()
+			if err != nil {
+				return "", err
 			}
+			return RenderReadme(readme.Name, readmeContents, smithyConfig.Markdown), nil
+		})
+		if err != nil {
+			formattedReadme = ""
 		}
+		return nil
+	})
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
 	}
 
-	ctx.HTML(http.StatusOK, "repo-index.html", makeTemplateContext(smithyConfig, gin.H{
-		"RepoName": repoName,
-		"Branches": bs,
-		"Tags":     ts,
-		"Readme":   template.HTML(formattedReadme),
-		"Repo":     repo,
+	if releaseErr != nil {
+		ctx.Error(releaseErr)
+	}
+
+	RespondWith(ctx, "repo-index.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":         repoName,
+		"Branches":         TruncateReferences(bs, smithyConfig.Index.MaxBranchesShown),
+		"BranchCount":      len(bs),
+		"Tags":             TruncateReferences(ts, smithyConfig.Index.MaxBranchesShown),
+		"TagCount":         len(ts),
+		"Readme":           template.HTML(formattedReadme),
+		"DocsRef":          docsRef,
+		"DefaultBranch":    defaultBranch,
+		"LicenseName":      licenseName,
+		"HasChangelog":     changelogName != "",
+		"ChangelogName":    changelogName,
+		"ContributorsName": contributorsName,
+		"LatestRelease":    latestRelease,
+		"Shallow":          IsShallowRepository(repo.Repository),
+		"Repo":             repo,
+		"PageTitle":        repo.DisplayName(smithyConfig.Index.ShowSlug),
+		"Language":         findLanguage(ctx, smithyConfig, repo),
 	}))
 }
 
@@ -333,6 +1454,28 @@ func RepoGitView(ctx *gin.Context, urlParts []string) {
 	git.ServeHTTP(ctx.Writer, ctx.Request)
 }
 
+// RepoStaticView serves files from a repository's static directory
+func RepoStaticView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists || repo.Meta.StaticDir == "" {
+		Http404(ctx)
+		return
+	}
+
+	dir := repo.Meta.StaticDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(repo.Path, dir)
+	}
+
+	// http.Dir keeps requests from escaping dir
+	ctx.Request.URL.Path = "/" + urlParts[1]
+	http.FileServer(http.Dir(dir)).ServeHTTP(ctx.Writer, ctx.Request)
+}
+
 func RefsView(ctx *gin.Context, urlParts []string) {
 	repoName := urlParts[0]
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
@@ -350,7 +1493,7 @@ func RefsView(ctx *gin.Context, urlParts []string) {
 		return
 	}
 
-	r, err := git.PlainOpen(repoPath)
+	r, err := OpenRepositoryWithEnv(repoPath)
 
 	if err != nil {
 		Http500(ctx)
@@ -363,15 +1506,23 @@ func RefsView(ctx *gin.Context, urlParts []string) {
 		bs = []*plumbing.Reference{}
 	}
 
-	ts, err := ListTags(r)
+	ts, err := ListTagsSortedBy(r, smithyConfig.Tags.SortBy)
 	if err != nil {
 		ts = []*plumbing.Reference{}
 	}
 
-	ctx.HTML(http.StatusOK, "refs.html", makeTemplateContext(smithyConfig, gin.H{
-		"RepoName": repoName,
-		"Branches": bs,
-		"Tags":     ts,
+	repo, _ := smithyConfig.FindRepo(repoName)
+	repo.Repository = r
+	defaultBranch, _, err := findDefaultBranch(smithyConfig, repo)
+	if err != nil {
+		ctx.Error(err)
+	}
+
+	renderHTML(ctx, http.StatusOK, "refs.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":      repoName,
+		"Branches":      bs,
+		"Tags":          GetTagDetails(r, ts),
+		"DefaultBranch": defaultBranch,
 	}))
 }
 
@@ -392,30 +1543,34 @@ func TreeView(ctx *gin.Context, urlParts []string) {
 		return
 	}
 
-	r, err := git.PlainOpen(repoPath)
+	r, err := OpenRepositoryWithEnv(repoPath)
 
 	if err != nil {
 		Http404(ctx)
 		return
 	}
 
-	var refNameString string
-
-	if len(urlParts) > 1 {
-		refNameString = urlParts[1]
-	} else {
-		refNameString, _, err = findMainBranch(ctx, r)
+	// Without a ref, send the visitor to the canonical URL of the default
+	// branch
+	if len(urlParts) < 2 {
+		repo, _ := smithyConfig.FindRepo(repoName)
+		repo.Repository = r
+		branch, _, err := findDefaultBranch(smithyConfig, repo)
 		if err != nil {
 			ctx.Error(err)
 			Http404(ctx)
 			return
 		}
+		ctx.Redirect(http.StatusFound, urlPrefix(ctx, smithyConfig)+TreeLink(repoName, branch, ""))
+		return
 	}
 
+	refNameString := urlParts[1]
+
 	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
 
 	if err != nil {
-		Http404(ctx)
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
 		return
 	}
 
@@ -443,12 +1598,29 @@ func TreeView(ctx *gin.Context, urlParts []string) {
 	// We're looking at the root of the project.  Show a list of files.
 	if treePath == "" {
 		entries := ConvertTreeEntries(tree.Entries)
+		if smithyConfig.Tree.HideDotFiles {
+			entries = FilterTreeEntries(entries, isVisibleTreeEntry)
+		}
+		entries, submodules := SplitSubmodules(commitObj, treePath, entries, smithyConfig.Git)
+		ResolveSymlinks(tree, entries)
 
-		ctx.HTML(http.StatusOK, "tree.html", makeTemplateContext(smithyConfig, gin.H{
-			"RepoName": repoName,
-			"RefName":  refNameString,
-			"Files":    entries,
-			"Path":     treePath,
+		if smithyConfig.Tree.ShowLastModified {
+			err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+				return SetLastModified(ctx, r, commitObj.Hash, treePath, entries, smithyConfig.Git.ShortHashLength)
+			})
+			if err != nil {
+				ctx.Error(err)
+				Http500(ctx)
+				return
+			}
+		}
+
+		RespondWith(ctx, "tree.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+			"RepoName":   repoName,
+			"RefName":    refNameString,
+			"Files":      entries,
+			"Submodules": submodules,
+			"Path":       treePath,
 		}))
 		return
 	}
@@ -456,7 +1628,7 @@ func TreeView(ctx *gin.Context, urlParts []string) {
 	out, err := tree.FindEntry(treePath)
 
 	if err != nil {
-		Http404(ctx)
+		Http404WithMessage(ctx, fmt.Sprintf("path %s not found at %s in repo %s", treePath, refNameString, repoName))
 		return
 	}
 
@@ -468,13 +1640,29 @@ func TreeView(ctx *gin.Context, urlParts []string) {
 			return
 		}
 		entries := ConvertTreeEntries(subTree.Entries)
-		ctx.HTML(http.StatusOK, "tree.html", makeTemplateContext(smithyConfig, gin.H{
+		if smithyConfig.Tree.HideDotFiles {
+			entries = FilterTreeEntries(entries, isVisibleTreeEntry)
+		}
+		entries, submodules := SplitSubmodules(commitObj, treePath, entries, smithyConfig.Git)
+		ResolveSymlinks(subTree, entries)
+		if smithyConfig.Tree.ShowLastModified {
+			err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+				return SetLastModified(ctx, r, commitObj.Hash, treePath, entries, smithyConfig.Git.ShortHashLength)
+			})
+			if err != nil {
+				ctx.Error(err)
+				Http500(ctx)
+				return
+			}
+		}
+		RespondWith(ctx, "tree.html", makeTemplateContext(ctx, smithyConfig, gin.H{
 			"RepoName":   repoName,
 			"ParentPath": parentPath,
 			"RefName":    refNameString,
 			"SubTree":    out.Name,
 			"Path":       treePath,
 			"Files":      entries,
+			"Submodules": submodules,
 		}))
 		return
 	}
@@ -486,90 +1674,318 @@ func TreeView(ctx *gin.Context, urlParts []string) {
 		Http404(ctx)
 		return
 	}
-	contents, err := file.Contents()
 
-	syntaxHighlighted, _ := RenderSyntaxHighlighting(file)
+	// Large files aren't read, let alone highlighted
+	if maxSize := int64(smithyConfig.Blob.MaxSizeKB) * 1024; maxSize > 0 && file.Size > maxSize {
+		RespondWith(ctx, "blob.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+			"RepoName":            repoName,
+			"RefName":             refNameString,
+			"File":                out,
+			"ParentPath":          parentPath,
+			"Path":                treePath,
+			"Encoding":            "",
+			"Contents":            "",
+			"ContentsHighlighted": template.HTML(""),
+			"Dependencies":        []Dependency(nil),
+			"ContentTruncated":    true,
+			"Size":                file.Size,
+		}))
+		return
+	}
+	var raw []byte
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		reader, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		raw, err = ioutil.ReadAll(reader)
+		return err
+	})
+	ObserveGitOperation(GitOperationTree, repoName, time.Since(start))
 
 	if err != nil {
-		Http404(ctx)
+		ctx.Error(err)
+		Http500(ctx)
 		return
 	}
-	ctx.HTML(http.StatusOK, "blob.html", makeTemplateContext(smithyConfig, gin.H{
-		"RepoName":            repoName,
-		"RefName":             refNameString,
-		"File":                out,
-		"ParentPath":          parentPath,
-		"Path":                treePath,
+
+	encoding, contents, err := DetectAndConvertEncoding(raw)
+	if err != nil {
+		encoding, contents = "unknown", string(raw)
+	}
+
+	if clientGone(ctx) {
+		return
+	}
+
+	// Licenses are plain text, whatever their extension says
+	var syntaxHighlighted string
+	if IsLicenseFile(path.Base(treePath)) {
+		syntaxHighlighted = RenderPlainText(contents)
+	} else {
+		syntaxHighlighted, _ = RenderSyntaxHighlighting(file.Name, contents, smithyConfig.Highlight)
+	}
+
+	// A manifest that doesn't parse is still shown, just without its
+	// dependencies
+	dependencies, err := ParseDependencies(path.Base(treePath), raw)
+	if err != nil {
+		dependencies = nil
+	}
+
+	RespondWith(ctx, "blob.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":            repoName,
+		"RefName":             refNameString,
+		"File":                out,
+		"ParentPath":          parentPath,
+		"Path":                treePath,
+		"Encoding":            encoding,
 		"Contents":            contents,
 		"ContentsHighlighted": template.HTML(syntaxHighlighted),
+		"Dependencies":        dependencies,
+		"ContentTruncated":    false,
+		"Size":                file.Size,
 	}))
 }
 
-func LogView(ctx *gin.Context, urlParts []string) {
+// BlameEntry is a line of a file along with the commit that last changed it
+type BlameEntry struct {
+	Number    int
+	Text      string
+	Hash      plumbing.Hash
+	ShortHash string
+	Author    string
+	Date      time.Time
+	// GroupStart is set on the first of consecutive lines from one commit
+	GroupStart bool
+	// GroupOdd alternates between groups so that they can be told apart
+	GroupOdd bool
+}
+
+// ConvertBlameLines turns go-git's blame result into BlameEntry values,
+// grouping consecutive lines from the same commit
+func ConvertBlameLines(r *git.Repository, lines []*git.Line, shortHashLength int) []BlameEntry {
+	results := []BlameEntry{}
+	odd := true
+
+	for i, line := range lines {
+		start := i == 0 || lines[i-1].Hash != line.Hash
+		if start {
+			odd = !odd
+		}
+
+		results = append(results, BlameEntry{
+			Number:     i + 1,
+			Text:       line.Text,
+			Hash:       line.Hash,
+			ShortHash:  ShortHash(r, line.Hash, shortHashLength),
+			Author:     line.Author,
+			Date:       line.Date,
+			GroupStart: start,
+			GroupOdd:   odd,
+		})
+	}
+
+	return results
+}
+
+// BlameView shows which commit last changed each line of a file
+func BlameView(ctx *gin.Context, urlParts []string) {
 	repoName := urlParts[0]
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
-	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
 
-	repoPathExists, err := PathExists(repoPath)
+	repo, exists := smithyConfig.FindRepo(repoName)
 
-	if err != nil {
+	if !exists {
 		Http404(ctx)
 		return
 	}
 
-	if !repoPathExists {
+	r := repo.Repository
+
+	refNameString := urlParts[1]
+	treePath := strings.Trim(urlParts[2], "/")
+
+	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
+		return
+	}
+
+	commitObj, err := r.CommitObject(*revision)
+
+	if err != nil {
 		Http404(ctx)
 		return
 	}
 
-	r, err := git.PlainOpen(repoPath)
+	file, err := commitObj.File(treePath)
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("file %s not found at %s in repo %s", treePath, refNameString, repoName))
+		return
+	}
+
+	// There are no lines to blame in binary files
+	binary, err := file.IsBinary()
+	if err != nil || binary {
+		ctx.Redirect(http.StatusFound, smithyConfig.Prefix+TreeLink(repoName, refNameString, treePath))
+		return
+	}
+
+	var lines []BlameEntry
+	var ignoredRevs []plumbing.Hash
+
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		ignoredRevs, err = LoadBlameIgnoreRevs(commitObj)
+		if err != nil {
+			return err
+		}
+
+		var blamed []*git.Line
+		if len(ignoredRevs) > 0 {
+			blamed, err = BlameIgnoringRevs(r, commitObj, treePath, ignoredRevs)
+			if err != nil {
+				return err
+			}
+		} else {
+			result, err := git.Blame(commitObj, treePath)
+			if err != nil {
+				return err
+			}
+			blamed = result.Lines
+		}
+
+		// Abbreviating hashes may mean listing every commit
+		lines = ConvertBlameLines(r, blamed, smithyConfig.Git.ShortHashLength)
+		return nil
+	})
+	ObserveGitOperation(GitOperationBlame, repoName, time.Since(start))
 
 	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	renderHTML(ctx, http.StatusOK, "blame.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":    repoName,
+		"RefName":     refNameString,
+		"Path":        treePath,
+		"ParentPath":  filepath.Dir(treePath),
+		"Name":        filepath.Base(treePath),
+		"Lines":       lines,
+		"IgnoredRevs": len(ignoredRevs),
+	}))
+}
+
+func isDocsTreeEntry(entry TreeEntry) bool {
+	return !entry.Mode.IsFile() || strings.HasSuffix(entry.Name, ".md")
+}
+
+// DocsView renders the markdown files in a repository's documentation
+// directory, and lists the files in it and its subdirectories
+func DocsView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
 		Http404(ctx)
 		return
 	}
 
 	refNameString := urlParts[1]
-	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
+	docsPath := strings.Trim(urlParts[2], "/")
+	treePath := path.Join(repo.Meta.Docs(), docsPath)
+
+	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(refNameString))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
+		return
+	}
+
+	commitObj, err := repo.Repository.CommitObject(*revision)
 
 	if err != nil {
 		Http404(ctx)
 		return
 	}
 
-	var commits []Commit
-	cIter, err := r.Log(&git.LogOptions{From: *revision, Order: git.LogOrderCommitterTime})
+	tree, err := commitObj.Tree()
 
 	if err != nil {
-		Http500(ctx)
+		Http404(ctx)
 		return
 	}
 
-	for i := 1; i <= PAGE_SIZE; i++ {
-		commit, err := cIter.Next()
+	out, err := tree.FindEntry(treePath)
 
-		if err == io.EOF {
-			break
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("path %s not found at %s in repo %s", treePath, refNameString, repoName))
+		return
+	}
+
+	if !out.Mode.IsFile() {
+		subTree, err := tree.Tree(treePath)
+		if err != nil {
+			Http404(ctx)
+			return
 		}
 
-		lines := strings.Split(commit.Message, "\n")
+		RespondWith(ctx, "docs.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+			"RepoName": repoName,
+			"RefName":  refNameString,
+			"Path":     docsPath,
+			"Files":    FilterTreeEntries(ConvertTreeEntries(subTree.Entries), isDocsTreeEntry),
+		}))
+		return
+	}
+
+	// Images and the like are linked from the documentation, send them as
+	// they are
+	if !strings.HasSuffix(treePath, ".md") {
+		ctx.Redirect(http.StatusFound, smithyConfig.Prefix+"/"+repoName+"/raw/"+refNameString+"/"+treePath)
+		return
+	}
 
-		c := Commit{
-			Commit:    commit,
-			Subject:   lines[0],
-			ShortHash: commit.Hash.String()[:8],
-		}
-		commits = append(commits, c)
+	file, err := tree.File(treePath)
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	var contents string
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		contents, err = file.Contents()
+		return err
+	})
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
 	}
 
-	ctx.HTML(http.StatusOK, "log.html", makeTemplateContext(smithyConfig, gin.H{
+	RespondWith(ctx, "docs.html", makeTemplateContext(ctx, smithyConfig, gin.H{
 		"RepoName": repoName,
 		"RefName":  refNameString,
-		"Commits":  commits,
+		"Path":     docsPath,
+		"Contents": template.HTML(FormatMarkdown(contents, smithyConfig.Markdown)),
 	}))
 }
 
-func LogViewDefault(ctx *gin.Context, urlParts []string) {
+// RawFileView sends the contents of a file as they are, without any markup
+func RawFileView(ctx *gin.Context, urlParts []string) {
 	repoName := urlParts[0]
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
 
@@ -580,64 +1996,220 @@ func LogViewDefault(ctx *gin.Context, urlParts []string) {
 		return
 	}
 
-	mainBranchName, _, err := findMainBranch(ctx, repo.Repository)
+	r := repo.Repository
+	refNameString := urlParts[1]
+	treePath := urlParts[2]
+
+	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
+		return
+	}
+
+	commitObj, err := r.CommitObject(*revision)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	tree, err := commitObj.Tree()
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	out, err := tree.FindEntry(treePath)
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("path %s not found at %s in repo %s", treePath, refNameString, repoName))
+		return
+	}
+
+	if !out.Mode.IsFile() {
+		ctx.String(http.StatusBadRequest, "%s is not a file", treePath)
+		return
+	}
+
+	file, err := tree.File(treePath)
 	if err != nil {
-		ctx.Error(err)
 		Http404(ctx)
 		return
 	}
 
-	ctx.Redirect(http.StatusPermanentRedirect, ctx.Request.RequestURI+"/"+mainBranchName)
+	reader, err := file.Reader()
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+	defer reader.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(treePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Files are served from the forge's own origin, so HTML and SVG in a
+	// repository mustn't run scripts or be sniffed into something that can.
+	// The policy replaces the one pages get.
+	ctx.Header("Content-Security-Policy", "sandbox")
+	ctx.DataFromReader(http.StatusOK, file.Size, contentType, reader, map[string]string{
+		"Content-Disposition":    fmt.Sprintf("inline; filename=%q", path.Base(treePath)),
+		"X-Content-Type-Options": "nosniff",
+	})
 }
 
-func GetChanges(commit *object.Commit) (object.Changes, error) {
-	var changes object.Changes
-	var parentTree *object.Tree
+// logPage is one page of a log
+type logPage struct {
+	commits   []Commit
+	nextHash  string
+	truncated bool
+}
 
-	parent, err := commit.Parent(0)
+// errNotInLog is returned by logDepth when the log doesn't list a commit
+var errNotInLog = errors.New("commit isn't in the log")
+
+// errMaxDepth is returned by maxDepthIter when there's more history past
+// the commits it may walk
+var errMaxDepth = errors.New("log reached its max depth")
+
+// maxDepthIter walks at most remaining commits of the wrapped iterator
+type maxDepthIter struct {
+	object.CommitIter
+	remaining int
+	// checkEnd tells running out of history right at the limit apart from
+	// truncating it
+	checkEnd bool
+}
+
+func (it *maxDepthIter) Next() (*object.Commit, error) {
+	if it.remaining == 0 {
+		if it.checkEnd {
+			if _, err := it.CommitIter.Next(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, errMaxDepth
+	}
+
+	commit, err := it.CommitIter.Next()
 	if err == nil {
-		parentTree, err = parent.Tree()
+		it.remaining--
+	}
+	return commit, err
+}
 
+func (it *maxDepthIter) ForEach(cb func(*object.Commit) error) error {
+	for {
+		commit, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return changes, err
+			return err
+		}
+		if err := cb(commit); err != nil {
+			if err == storer.ErrStop {
+				return nil
+			}
+			return err
 		}
 	}
+}
 
-	currentTree, err := commit.Tree()
+// newLogIter walks the history from revision the way the log view asks
+// for, only listing the commits that touched filePath when it's set.  When
+// maxDepth isn't 0, the walk stops with errMaxDepth after visiting that
+// many commits, whether they're listed or not.
+func newLogIter(r *git.Repository, revision plumbing.Hash, view, filePath string, shallow bool, maxDepth int) (object.CommitIter, error) {
+	var cIter object.CommitIter
+
+	switch {
+	case view == "first-parent":
+		var missing map[plumbing.Hash]bool
+		if shallow {
+			var err error
+			missing, err = missingParents(r)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	if err != nil {
-		return changes, err
+		commitObj, err := r.CommitObject(revision)
+		if err != nil {
+			return nil, err
+		}
+		cIter = NewFirstParentIter(commitObj, missing)
+	case shallow:
+		var err error
+		cIter, err = NewShallowLogIter(r, revision)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		cIter, err = r.Log(&git.LogOptions{From: revision, Order: git.LogOrderCommitterTime})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return object.DiffTree(parentTree, currentTree)
+	if maxDepth > 0 {
+		if filePath != "" {
+			// The file filter reads one commit ahead to see what changed
+			// in the one before it, so that read is the one that finds out
+			// whether there's more history
+			cIter = &maxDepthIter{CommitIter: cIter, remaining: maxDepth + 1}
+		} else {
+			cIter = &maxDepthIter{CommitIter: cIter, remaining: maxDepth, checkEnd: true}
+		}
+	}
 
+	if filePath != "" {
+		cIter = object.NewCommitFileIterFromIter(filePath, cIter, false)
+	}
+	return cIter, nil
 }
 
-// FormatChanges spits out something similar to `git diff`
-func FormatChanges(changes object.Changes) (string, error) {
-	var s []string
-	for _, change := range changes {
-		patch, err := change.Patch()
+// logDepth counts the commits the log from tip walks before after, which is
+// where a later page starts.  Commits are counted whether they touched the
+// file of a file's log or not.  It stops counting at max.
+func logDepth(ctx context.Context, r *git.Repository, tip, after plumbing.Hash, view string, shallow bool, max int) (int, error) {
+	cIter, err := newLogIter(r, tip, view, "", shallow, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer cIter.Close()
+
+	for depth := 0; depth < max; depth++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		commit, err := cIter.Next()
+		if err == io.EOF {
+			return 0, errNotInLog
+		}
 		if err != nil {
-			return "", err
+			return 0, err
+		}
+
+		if commit.Hash == after {
+			return depth, nil
 		}
-		s = append(s, PatchHTML(*patch))
 	}
 
-	return strings.Join(s, "\n\n\n\n"), nil
+	return max, nil
 }
 
-func PatchView(ctx *gin.Context, urlParts []string) {
-	const commitFormatDate = "Mon, 2 Jan 2006 15:04:05 -0700"
+func LogView(ctx *gin.Context, urlParts []string) {
 	repoName := urlParts[0]
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
 	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
 
-	var (
-		patch string
-		err   error
-	)
-
 	repoPathExists, err := PathExists(repoPath)
 
 	if err != nil {
@@ -645,209 +2217,1518 @@ func PatchView(ctx *gin.Context, urlParts []string) {
 		return
 	}
 
-	if !repoPathExists {
-		Http404(ctx)
-		return
+	if !repoPathExists {
+		Http404(ctx)
+		return
+	}
+
+	r, err := OpenRepositoryWithEnv(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	refNameString := urlParts[1]
+	revision, err := r.ResolveRevision(plumbing.Revision(refNameString))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refNameString, repoName))
+		return
+	}
+	tip := *revision
+
+	// The log of a single file only lists the commits that touched it
+	var filePath string
+	if len(urlParts) > 2 {
+		filePath = strings.TrimSuffix(urlParts[2], "/")
+	}
+
+	// Later pages start at the first commit that didn't fit on the previous
+	// one
+	after := ctx.Query("after")
+	if after != "" {
+		afterHash := plumbing.NewHash(after)
+		if _, err := r.CommitObject(afterHash); err != nil {
+			Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in repo %s", after, repoName))
+			return
+		}
+		revision = &afterHash
+	}
+
+	maxDepth := smithyConfig.Log.MaxDepth
+
+	view := ctx.Query("view")
+	shallow := IsShallowRepository(r)
+
+	switch view {
+	case "", "graph", "first-parent":
+	default:
+		ctx.String(http.StatusBadRequest, "unknown log view %q", view)
+		return
+	}
+
+	if clientGone(ctx) {
+		return
+	}
+
+	var page logPage
+
+	// Concurrent requests for the same page share one walk
+	key := fmt.Sprintf("log:%s:%s:%s:%s:%s:%d", repoName, tip, revision, view, filePath, maxDepth)
+	from := *revision
+
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		page, err = shareGitOperation(ctx, key, func(ctx context.Context) (logPage, error) {
+			var page logPage
+
+			// Only walk as far as the configured depth allows, counting
+			// the commits before the page from the tip rather than trusting
+			// the client to say where the page is
+			remaining := 0
+			if maxDepth > 0 {
+				depth := 0
+				if from != tip {
+					var err error
+					depth, err = logDepth(ctx, r, tip, from, view, shallow, maxDepth)
+					if err != nil {
+						return page, err
+					}
+				}
+				if depth >= maxDepth {
+					page.truncated = true
+					return page, nil
+				}
+				remaining = maxDepth - depth
+			}
+
+			cIter, err := newLogIter(r, from, view, filePath, shallow, remaining)
+			if err != nil {
+				return page, err
+			}
+			defer cIter.Close()
+
+			for i := 1; i <= PAGE_SIZE+1; i++ {
+				if err := ctx.Err(); err != nil {
+					return page, err
+				}
+
+				commit, err := cIter.Next()
+
+				if err == io.EOF {
+					break
+				}
+
+				if err == errMaxDepth {
+					page.truncated = true
+					break
+				}
+
+				if err != nil {
+					return page, err
+				}
+
+				// One commit more than fits tells us where the next page
+				// starts
+				if i > PAGE_SIZE {
+					page.nextHash = commit.Hash.String()
+					break
+				}
+
+				page.commits = append(page.commits, NewCommit(r, commit, smithyConfig.Log.MaxSubjectLength, smithyConfig.Git.ShortHashLength))
+			}
+			return page, nil
+		})
+		return err
+	})
+	ObserveGitOperation(GitOperationLog, repoName, time.Since(start))
+
+	// The walk is shared with other requests, so it's only given up on
+	// afterwards
+	if clientGone(ctx) {
+		return
+	}
+
+	if errors.Is(err, errNotInLog) {
+		Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in the log of %s", after, refNameString))
+		return
+	}
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	commits, nextHash, truncated := page.commits, page.nextHash, page.truncated
+
+	if view == "graph" {
+		ctx.JSON(http.StatusOK, gin.H{
+			"ref":       refNameString,
+			"commits":   ConvertGraphNodes(commits),
+			"next":      nextHash,
+			"truncated": truncated,
+		})
+		return
+	}
+
+	RespondWith(ctx, "log.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":  repoName,
+		"RefName":   refNameString,
+		"Path":      filePath,
+		"View":      view,
+		"Commits":   commits,
+		"After":     after,
+		"Shallow":   shallow,
+		"HasMore":   nextHash != "",
+		"NextHash":  nextHash,
+		"Truncated": truncated,
+		"MaxDepth":  smithyConfig.Log.MaxDepth,
+	}))
+}
+
+func LogViewDefault(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	branch, _, err := findDefaultBranch(smithyConfig, repo)
+	if err != nil {
+		ctx.Error(err)
+		Http404(ctx)
+		return
+	}
+
+	ctx.Redirect(http.StatusPermanentRedirect, urlPrefix(ctx, smithyConfig)+ctx.Request.URL.Path+"/"+branch)
+}
+
+func GetChanges(commit *object.Commit) (object.Changes, error) {
+	var changes object.Changes
+	var parentTree *object.Tree
+
+	parent, err := commit.Parent(0)
+	if err == nil {
+		parentTree, err = parent.Tree()
+
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	currentTree, err := commit.Tree()
+
+	if err != nil {
+		return changes, err
+	}
+
+	return object.DiffTree(parentTree, currentTree)
+
+}
+
+// DiffOptions control how FormatChanges renders diffs
+type DiffOptions struct {
+	// ContextLines is how many unchanged lines are shown around changes
+	ContextLines int
+
+	// ShortHashLength is how many characters of the hashes in index lines
+	// are shown
+	ShortHashLength int
+
+	// WordDiff highlights the words that changed within changed lines
+	WordDiff bool
+
+	// Style is DiffStyleUnified or DiffStyleSplit
+	Style string
+
+	// MaxFileDiffBytes is the size above which a file's diff is left out,
+	// 0 means no limit
+	MaxFileDiffBytes int
+
+	// PatchURL is where the whole patch can be downloaded from, it's linked
+	// in place of the diffs that are left out
+	PatchURL string
+}
+
+// Ways diffs can be laid out
+const (
+	DiffStyleUnified = "unified"
+	DiffStyleSplit   = "split"
+)
+
+// patchSize is roughly how many bytes the diff of patch takes when it's
+// shown with contextLines unchanged lines around each change.  Unchanged
+// chunks hold the rest of the file, only the lines shown of them count.
+func patchSize(patch *object.Patch, contextLines int) int {
+	size := 0
+	for _, fp := range patch.FilePatches() {
+		chunks := fp.Chunks()
+		for i, chunk := range chunks {
+			content := chunk.Content()
+			if chunk.Type() != diff.Equal {
+				size += len(content)
+				continue
+			}
+
+			lines := strings.SplitAfter(content, "\n")
+			if lines[len(lines)-1] == "" {
+				lines = lines[:len(lines)-1]
+			}
+			before, after := 0, 0
+			if i > 0 {
+				before = contextLines
+			}
+			if i < len(chunks)-1 {
+				after = contextLines
+			}
+			if before+after >= len(lines) {
+				size += len(content)
+				continue
+			}
+
+			for _, line := range lines[:before] {
+				size += len(line)
+			}
+			for _, line := range lines[len(lines)-after:] {
+				size += len(line)
+			}
+		}
+	}
+	return size
+}
+
+// changeName is the path of the file change touches
+func changeName(change *object.Change) string {
+	if change.To.Name != "" {
+		return change.To.Name
+	}
+	return change.From.Name
+}
+
+// truncatedDiffHTML stands in for a diff of size bytes that's too large to
+// show
+func truncatedDiffHTML(name string, size int, options DiffOptions) string {
+	var sb strings.Builder
+	sb.WriteString(`<div class="diff-truncated">`)
+	fmt.Fprintf(&sb, "<strong>%s</strong> Diff too large (%d bytes).", template.HTMLEscapeString(name), size)
+	if options.PatchURL != "" {
+		fmt.Fprintf(&sb, ` <a href="%s">Download patch</a>`, template.HTMLEscapeString(options.PatchURL))
+	}
+	sb.WriteString("</div>")
+	return sb.String()
+}
+
+// FormatChanges spits out something similar to `git diff`, given the
+// changes and their patches from ChangePatches
+func FormatChanges(changes object.Changes, patches []*object.Patch, options DiffOptions) string {
+	var s []string
+	for i, change := range changes {
+		patch := patches[i]
+
+		if size := patchSize(patch, options.ContextLines); options.MaxFileDiffBytes > 0 && size > options.MaxFileDiffBytes {
+			s = append(s, truncatedDiffHTML(changeName(change), size, options))
+			continue
+		}
+
+		s = append(s, PatchHTML(*patch, options))
+	}
+
+	return strings.Join(s, "\n\n\n\n")
+}
+
+// Default and largest number of ancestors CommitAncestorsView returns
+const (
+	DefaultAncestorsDepth = 20
+	MaxAncestorsDepth     = 1000
+)
+
+type ancestorsParams struct {
+	// Keep max in sync with MaxAncestorsDepth
+	Depth int `query:"depth" min:"1" max:"1000"`
+}
+
+// CommitAncestorsView lists the first-parent ancestors of a commit, nearest
+// first, so that clients can bisect through them
+func CommitAncestorsView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
+
+	repoPathExists, err := PathExists(repoPath)
+
+	if err != nil || !repoPathExists {
+		Http404(ctx)
+		return
+	}
+
+	r, err := OpenRepositoryWithEnv(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	params, err := ParseQueryParams(ctx, ancestorsParams{Depth: DefaultAncestorsDepth})
+	if err != nil {
+		return
+	}
+	depth := params.Depth
+
+	commitID := urlParts[1]
+	commitObj, err := r.CommitObject(plumbing.NewHash(commitID))
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in repo %s", commitID, repoName))
+		return
+	}
+
+	ancestors := []Ancestor{}
+
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		missing, err := missingParents(r)
+		if err != nil {
+			return err
+		}
+
+		iter := NewFirstParentIter(commitObj, missing)
+		defer iter.Close()
+
+		// Skip the commit itself
+		if _, err := iter.Next(); err != nil {
+			return err
+		}
+
+		return iter.ForEach(func(commit *object.Commit) error {
+			if len(ancestors) >= depth {
+				return storer.ErrStop
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			ancestors = append(ancestors, Ancestor{
+				Hash:    commit.Hash.String(),
+				Subject: strings.Split(commit.Message, "\n")[0],
+				Date:    commit.Author.When,
+			})
+			return nil
+		})
+	})
+	ObserveGitOperation(GitOperationLog, repoName, time.Since(start))
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ancestors)
+}
+
+func PatchView(ctx *gin.Context, urlParts []string) {
+	const commitFormatDate = "Mon, 2 Jan 2006 15:04:05 -0700"
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
+
+	var (
+		patch string
+		err   error
+	)
+
+	repoPathExists, err := PathExists(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	if !repoPathExists {
+		Http404(ctx)
+		return
+	}
+
+	r, err := OpenRepositoryWithEnv(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	commitID := urlParts[1]
+	if commitID == "" {
+		Http404(ctx)
+		return
+	}
+
+	commitHash := plumbing.NewHash(commitID)
+	commitObj, err := r.CommitObject(commitHash)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	// TODO: If this is the first commit, we can't build the diff (#281)
+	// Therefore, we have two options: either build the diff manually or
+	// patch go-git
+	if commitObj.NumParents() == 0 {
+		Http500(ctx)
+		return
+	} else {
+		parentCommit, err := commitObj.Parent(0)
+
+		if err != nil {
+			Http500(ctx)
+			return
+		}
+
+		patchObj, err := parentCommit.Patch(commitObj)
+		patch = patchObj.String()
+	}
+
+	commitHashStr := fmt.Sprintf("From %s Mon Sep 17 00:00:00 2001", commitObj.Hash)
+	from := fmt.Sprintf("From: %s <%s>", commitObj.Author.Name, commitObj.Author.Email)
+	date := fmt.Sprintf("Date: %s", commitObj.Author.When.Format(commitFormatDate))
+	subject := fmt.Sprintf("Subject: [PATCH] %s", commitObj.Message)
+
+	stats, err := commitObj.Stats()
+	if err != nil {
+		Http500(ctx)
+		return
+	}
+
+	ctx.String(http.StatusOK, "%s\n%s\n%s\n%s\n---\n%s\n%s",
+		commitHashStr, from, date, subject, stats.String(), patch)
+}
+
+// commitParams are the query parameters of the commit view
+type commitParams struct {
+	// Context overrides the configured number of context lines
+	Context int `query:"context" min:"0"`
+
+	// WordDiff highlights the words that changed within changed lines
+	WordDiff bool `query:"word_diff"`
+
+	// DiffStyle lays the diff out in one or two columns
+	DiffStyle string `query:"diff_style"`
+}
+
+// TagView shows a tag, with the message and tagger of annotated ones
+func TagView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	tagName := urlParts[1]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	ref, err := repo.Repository.Tag(tagName)
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("tag %s not found in repo %s", tagName, repoName))
+		return
+	}
+
+	tag := GetTagDetail(repo.Repository, ref)
+
+	// Tags of trees and blobs have no commit to show
+	commit, err := repo.Repository.CommitObject(tag.Target)
+	if err != nil {
+		commit = nil
+	}
+
+	RespondWith(ctx, "tag.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName": repoName,
+		"Tag":      tag,
+		"Commit":   commit,
+	}))
+}
+
+// ShortCommitView redirects a commit page addressed by a short hash, as
+// copied from a terminal, to the one of its full hash
+func ShortCommitView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	var hash plumbing.Hash
+	err := smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		hash, err = ResolveShortHash(repo.Repository, urlParts[1])
+		return err
+	})
+	if err == ErrAmbiguousHash {
+		Http404WithMessage(ctx, fmt.Sprintf("%s is ambiguous in repo %s, use a longer hash", urlParts[1], repoName))
+		return
+	}
+	if err == ErrOperationTimeout {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in repo %s", urlParts[1], repoName))
+		return
+	}
+
+	target := fmt.Sprintf("%s/%s/commit/%s", urlPrefix(ctx, smithyConfig), repoName, hash)
+	if ctx.Request.URL.RawQuery != "" {
+		target += "?" + ctx.Request.URL.RawQuery
+	}
+	ctx.Redirect(http.StatusMovedPermanently, target)
+}
+
+func CommitView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
+
+	repoPathExists, err := PathExists(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	if !repoPathExists {
+		Http404(ctx)
+		return
+	}
+
+	r, err := OpenRepositoryWithEnv(repoPath)
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+	commitID := urlParts[1]
+	if commitID == "" {
+		Http404(ctx)
+		return
+	}
+	commitHash := plumbing.NewHash(commitID)
+	commitObj, err := r.CommitObject(commitHash)
+
+	if err != nil {
+		Http404WithMessage(ctx, fmt.Sprintf("commit %s not found in repo %s", commitID, repoName))
+		return
+	}
+
+	params, err := ParseQueryParams(ctx, commitParams{
+		Context:   smithyConfig.Diff.ContextLines,
+		DiffStyle: DiffStyleUnified,
+	})
+	if err != nil {
+		return
+	}
+
+	if params.DiffStyle != DiffStyleUnified && params.DiffStyle != DiffStyleSplit {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("diff_style must be %s or %s", DiffStyleUnified, DiffStyleSplit),
+		})
+		return
+	}
+
+	options := smithyConfig.DiffOptions()
+	options.ContextLines = params.Context
+	options.WordDiff = params.WordDiff
+	options.Style = params.DiffStyle
+	options.PatchURL = fmt.Sprintf("%s/%s/commit/%s.patch", smithyConfig.Prefix, repoName, commitObj.Hash)
+	if options.ContextLines > smithyConfig.Diff.MaxContextLines {
+		options.ContextLines = smithyConfig.Diff.MaxContextLines
+	}
+
+	var changes object.Changes
+	var formattedChanges string
+	var stats DiffStats
+	var shortHash string
+
+	if clientGone(ctx) {
+		return
+	}
+
+	start := time.Now()
+	err = smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		// Abbreviating hashes may mean listing every commit
+		shortHash = ShortHash(r, commitObj.Hash, smithyConfig.Git.ShortHashLength)
+
+		var err error
+		changes, err = GetChanges(commitObj)
+		if err != nil {
+			return err
+		}
+
+		patches, err := ChangePatches(changes)
+		if err != nil {
+			return err
+		}
+		stats = ComputeDiffStats(patches)
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("diff:%s:%s:%v", repoName, commitObj.Hash, options)
+		formattedChanges, err = smithyConfig.renderCache.GetOrRender(key, func() (string, error) {
+			return FormatChanges(changes, patches, options), nil
+		})
+		return err
+	})
+	ObserveGitOperation(GitOperationDiff, repoName, time.Since(start))
+
+	if clientGone(ctx) {
+		return
+	}
+
+	if err == ErrOperationTimeout {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	if err != nil {
+		Http404(ctx)
+		return
+	}
+
+	var keyID string
+	if commitObj.PGPSignature != "" {
+		keyID, err = ExtractPGPKeyID(commitObj.PGPSignature)
+		if err != nil {
+			ctx.Error(err)
+		}
+	}
+
+	RespondWith(ctx, "commit.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":  repoName,
+		"Commit":    commitObj,
+		"ShortHash": shortHash,
+		"DiffStyle": options.Style,
+		"DiffStats": stats,
+		"Files":     ConvertChangedFilesWithStats(changes, stats),
+		"Changes":   template.HTML(formattedChanges),
+		"KeyID":     keyID,
+		"KeyURL":    PGPKeyURL(keyID),
+	}))
+}
+
+// CommitsBetween lists the commits reachable from to but not from from,
+// newest first, like `git log from..to`.  It stops with ctx's error once
+// it's done.
+func CommitsBetween(ctx context.Context, r *git.Repository, from, to *object.Commit) ([]*object.Commit, error) {
+	seen, err := missingParents(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = object.NewCommitIterCTime(from, seen, nil).ForEach(func(c *object.Commit) error {
+		seen[c.Hash] = true
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []*object.Commit
+	err = object.NewCommitIterCTime(to, seen, nil).ForEach(func(c *object.Commit) error {
+		commits = append(commits, c)
+		return ctx.Err()
+	})
+
+	return commits, err
+}
+
+// resolveCompareRefs looks up the commits compared, answering with a 404 and
+// returning false when either of them can't be found
+func resolveCompareRefs(ctx *gin.Context, r *git.Repository, repoName, fromRef, toRef string) (*object.Commit, *object.Commit, bool) {
+	var refCommits []*object.Commit
+	for _, refName := range []string{fromRef, toRef} {
+		revision, err := r.ResolveRevision(plumbing.Revision(refName))
+		if err != nil {
+			Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refName, repoName))
+			return nil, nil, false
+		}
+
+		commitObj, err := r.CommitObject(*revision)
+		if err != nil {
+			Http404WithMessage(ctx, fmt.Sprintf("ref %s not found in repo %s", refName, repoName))
+			return nil, nil, false
+		}
+
+		refCommits = append(refCommits, commitObj)
+	}
+
+	return refCommits[0], refCommits[1], true
+}
+
+// ComparePatchView sends the combined diff between two refs as a patch
+func ComparePatchView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	from, to, ok := resolveCompareRefs(ctx, repo.Repository, repoName, urlParts[1], urlParts[2])
+	if !ok {
+		return
+	}
+
+	var patch string
+
+	start := time.Now()
+	err := smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		patchObj, err := from.Patch(to)
+		if err != nil {
+			return err
+		}
+		patch = patchObj.String()
+		return nil
+	})
+	ObserveGitOperation(GitOperationDiff, repoName, time.Since(start))
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	ctx.String(http.StatusOK, "%s", patch)
+}
+
+// CompareView shows the commits and the combined diff between two refs
+func CompareView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	r := repo.Repository
+
+	from, to, ok := resolveCompareRefs(ctx, r, repoName, urlParts[1], urlParts[2])
+	if !ok {
+		return
+	}
+	identical := from.Hash == to.Hash
+
+	var commits []Commit
+	var changes object.Changes
+	var formattedChanges string
+	var stats DiffStats
+
+	if clientGone(ctx) {
+		return
+	}
+
+	start := time.Now()
+	err := smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		if identical {
+			return nil
+		}
+
+		between, err := CommitsBetween(ctx, r, from, to)
+		if err != nil {
+			return err
+		}
+
+		for _, commit := range between {
+			commits = append(commits, NewCommit(r, commit, smithyConfig.Log.MaxSubjectLength, smithyConfig.Git.ShortHashLength))
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fromTree, err := from.Tree()
+		if err != nil {
+			return err
+		}
+
+		toTree, err := to.Tree()
+		if err != nil {
+			return err
+		}
+
+		changes, err = object.DiffTree(fromTree, toTree)
+		if err != nil {
+			return err
+		}
+
+		patches, err := ChangePatches(changes)
+		if err != nil {
+			return err
+		}
+		stats = ComputeDiffStats(patches)
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		options := smithyConfig.DiffOptions()
+		options.PatchURL = fmt.Sprintf("%s/%s/compare/%s...%s.patch", smithyConfig.Prefix, repoName, from.Hash, to.Hash)
+		key := fmt.Sprintf("diff:%s:%s..%s:%v", repoName, from.Hash, to.Hash, options)
+		formattedChanges, err = smithyConfig.renderCache.GetOrRender(key, func() (string, error) {
+			return FormatChanges(changes, patches, options), nil
+		})
+		return err
+	})
+	ObserveGitOperation(GitOperationDiff, repoName, time.Since(start))
+
+	if clientGone(ctx) {
+		return
+	}
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	RespondWith(ctx, "compare.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName":  repoName,
+		"From":      urlParts[1],
+		"To":        urlParts[2],
+		"ToHash":    to.Hash.String(),
+		"Identical": identical,
+		"Commits":   commits,
+		"DiffStats": stats,
+		"Files":     ConvertChangedFilesWithStats(changes, stats),
+		"Changes":   template.HTML(formattedChanges),
+	}))
+}
+
+func ListBranches(r *git.Repository) ([]*plumbing.Reference, error) {
+	it, err := r.Branches()
+	if err != nil {
+		return []*plumbing.Reference{}, err
+	}
+
+	return ReferenceCollector(it)
+}
+
+func ListTags(r *git.Repository) ([]*plumbing.Reference, error) {
+	it, err := r.Tags()
+	if err != nil {
+		return []*plumbing.Reference{}, err
+	}
+
+	return ReferenceCollector(it)
+}
+
+// TagDetail describes a tag.  Only annotated tags have a message and a
+// tagger, lightweight ones are just a name for a commit.
+type TagDetail struct {
+	Name        string
+	IsAnnotated bool
+	Message     string
+	TaggerName  string
+	TaggerDate  time.Time
+
+	// Target is the hash of the object the tag points at, usually a commit
+	Target plumbing.Hash
+}
+
+// GetTagDetail describes the tag ref
+func GetTagDetail(r *git.Repository, ref *plumbing.Reference) TagDetail {
+	detail := TagDetail{Name: ref.Name().Short(), Target: ref.Hash()}
+
+	tag, err := r.TagObject(ref.Hash())
+	if err != nil {
+		return detail
+	}
+
+	detail.IsAnnotated = true
+	detail.Message = tag.Message
+	detail.TaggerName = tag.Tagger.Name
+	detail.TaggerDate = tag.Tagger.When
+	detail.Target = tag.Target
+	return detail
+}
+
+// GetTagDetails describes the tags refs, in the same order
+func GetTagDetails(r *git.Repository, refs []*plumbing.Reference) []TagDetail {
+	details := make([]TagDetail, 0, len(refs))
+	for _, ref := range refs {
+		details = append(details, GetTagDetail(r, ref))
+	}
+	return details
+}
+
+// TruncateReferences returns at most max references, 0 means no limit
+func TruncateReferences(refs []*plumbing.Reference, max int) []*plumbing.Reference {
+	if max <= 0 || len(refs) <= max {
+		return refs
+	}
+	return refs[:max]
+}
+
+// Orders tags can be listed in
+const (
+	TagSortName   = "name"
+	TagSortDate   = "date"
+	TagSortSemver = "semver"
+)
+
+// ListTagsSortedBy lists tags in one of the TagSort orders
+func ListTagsSortedBy(r *git.Repository, sortBy string) ([]*plumbing.Reference, error) {
+	switch sortBy {
+	case TagSortDate:
+		return ListTagsSortedByDate(r)
+	case TagSortSemver:
+		return ListTagsSortedBySemver(r)
+	}
+	return ListTags(r)
+}
+
+// tagDate is the tagger date of an annotated tag or the commit date of a
+// lightweight one
+func tagDate(r *git.Repository, ref *plumbing.Reference) time.Time {
+	if tag, err := r.TagObject(ref.Hash()); err == nil {
+		return tag.Tagger.When
+	}
+
+	if commit, err := r.CommitObject(ref.Hash()); err == nil {
+		return commit.Committer.When
+	}
+
+	return time.Time{}
+}
+
+// ListTagsSortedByDate lists tags newest first
+func ListTagsSortedByDate(r *git.Repository) ([]*plumbing.Reference, error) {
+	refs, err := ListTags(r)
+	if err != nil {
+		return refs, err
+	}
+
+	dates := map[plumbing.ReferenceName]time.Time{}
+	for _, ref := range refs {
+		dates[ref.Name()] = tagDate(r, ref)
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		return dates[refs[i].Name()].After(dates[refs[j].Name()])
+	})
+
+	return refs, nil
+}
+
+// tagVersion returns the semantic version a tag is named after, with or
+// without the leading v, or an empty string
+func tagVersion(ref *plumbing.Reference) string {
+	version := ref.Name().Short()
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+
+	if !semver.IsValid(version) {
+		return ""
+	}
+	return version
+}
+
+// ListTagsSortedBySemver lists the tags that are semantic versions highest
+// first, followed by the others by name
+func ListTagsSortedBySemver(r *git.Repository) ([]*plumbing.Reference, error) {
+	refs, err := ListTags(r)
+	if err != nil {
+		return refs, err
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		a, b := tagVersion(refs[i]), tagVersion(refs[j])
+		if a == "" || b == "" {
+			return a != "" && b == ""
+		}
+		return semver.Compare(a, b) > 0
+	})
+
+	return refs, nil
+}
+
+func ReferenceCollector(it storer.ReferenceIter) ([]*plumbing.Reference, error) {
+	refs := []*plumbing.Reference{}
+
+	for {
+		b, err := it.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return refs, err
+		}
+
+		refs = append(refs, b)
+	}
+
+	sort.Sort(ReferenceByName(refs))
+	return refs, nil
+}
+
+// Make the config available to every request
+func AddConfigMiddleware(holder *ConfigHolder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("config", holder.Get())
+	}
+}
+
+// CSPNonceMiddleware generates a nonce for each request and sends a
+// Content-Security-Policy that only runs scripts carrying it
+func CSPNonceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			c.Error(err)
+			Http500(c)
+			c.Abort()
+			return
+		}
+
+		encoded := base64.RawURLEncoding.EncodeToString(nonce)
+		c.Set("csp_nonce", encoded)
+		c.Header("Content-Security-Policy", fmt.Sprintf("script-src 'nonce-%s' 'strict-dynamic'", encoded))
+	}
+}
+
+// Refuse request bodies larger than limit
+func MaxRequestBodyMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			return
+		}
+
+		tooLarge := func() {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("request body exceeds %d bytes", limit),
+			})
+		}
+
+		if c.Request.ContentLength > limit {
+			tooLarge()
+			return
+		}
+
+		// Bodies without a declared length are cut off while being read,
+		// views leave answering that to here, see requestBodyTooLarge
+		body := &maxBytesBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit), limit: limit}
+		c.Request.Body = body
+
+		c.Next()
+
+		if body.exceeded && !c.Writer.Written() {
+			tooLarge()
+		}
+	}
+}
+
+// maxBytesBody is a request body cut off by http.MaxBytesReader that
+// remembers whether it was
+type maxBytesBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// requestBodyTooLarge reports whether reading the request's body stopped
+// at max_request_body_bytes, which MaxRequestBodyMiddleware answers with a
+// 413 as long as the view hasn't written anything
+func requestBodyTooLarge(ctx *gin.Context) bool {
+	body, ok := ctx.Request.Body.(*maxBytesBody)
+	return ok && body.exceeded
+}
+
+// Redirect requests that reached the proxy in front of smithy over plain
+// HTTP to the HTTPS version of the URL on host
+func ForceHTTPSMiddleware(host string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("X-Forwarded-Proto") != "http" {
+			return
+		}
+
+		target := host
+		if target == "" {
+			target = c.Request.Host
+		}
+
+		c.Redirect(http.StatusMovedPermanently, "https://"+target+c.Request.URL.RequestURI())
+		c.Abort()
+	}
+}
+
+// RedirectMiddleware sends requests matching one of the rules to its
+// target.  Targets starting with a slash are paths within smithy.
+func RedirectMiddleware(rules []RedirectRule, prefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		urlPath := c.Request.URL.Path
+
+		for _, rule := range rules {
+			match := rule.regex.FindStringSubmatchIndex(urlPath)
+			if match == nil {
+				continue
+			}
+
+			target := string(rule.regex.ExpandString(nil, rule.To, urlPath, match))
+			if strings.HasPrefix(target, "/") {
+				target = prefix + target
+			}
+			if c.Request.URL.RawQuery != "" && !strings.Contains(target, "?") {
+				target += "?" + c.Request.URL.RawQuery
+			}
+
+			c.Redirect(rule.Code, target)
+			c.Abort()
+			return
+		}
 	}
+}
 
-	r, err := git.PlainOpen(repoPath)
+// Strip prefix from request paths so that routing doesn't have to know
+// about it.  Paths without the prefix, e.g. from a proxy that already
+// removed it, are left alone.
+func PrefixMiddleware(prefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if prefix == "" {
+			return
+		}
 
-	if err != nil {
-		Http404(ctx)
-		return
-	}
+		urlPath := c.Request.URL.Path
+		if urlPath != prefix && !strings.HasPrefix(urlPath, prefix+"/") {
+			return
+		}
 
-	commitID := urlParts[1]
-	if commitID == "" {
-		Http404(ctx)
-		return
+		urlPath = strings.TrimPrefix(urlPath, prefix)
+		if urlPath == "" {
+			urlPath = "/"
+		}
+
+		c.Request.URL.Path = urlPath
+		c.Request.URL.RawPath = ""
 	}
+}
 
-	commitHash := plumbing.NewHash(commitID)
-	commitObj, err := r.CommitObject(commitHash)
+// PatchHTML returns an HTML representation of a patch
+func PatchHTML(p object.Patch, options DiffOptions) string {
+	buf := bytes.NewBuffer(nil)
 
+	var err error
+	if options.Style == DiffStyleSplit {
+		err = NewSideBySideEncoder(buf, options.ContextLines).
+			SetHashLength(options.ShortHashLength).
+			Encode(p)
+	} else {
+		err = NewUnifiedEncoder(buf, options.ContextLines).
+			SetHashLength(options.ShortHashLength).
+			SetWordDiff(options.WordDiff).
+			Encode(p)
+	}
 	if err != nil {
-		Http404(ctx)
-		return
+		fmt.Println("PatchHTML error")
 	}
+	return buf.String()
+}
 
-	// TODO: If this is the first commit, we can't build the diff (#281)
-	// Therefore, we have two options: either build the diff manually or
-	// patch go-git
-	if commitObj.NumParents() == 0 {
-		Http500(ctx)
-		return
-	} else {
-		parentCommit, err := commitObj.Parent(0)
-
-		if err != nil {
-			Http500(ctx)
+// WithETagCaching answers requests whose If-None-Match header matches the
+// ETag etagFn computes with a 304 before handler does any git work.  An
+// empty ETag turns caching off for the request.  Pages addressed by a full
+// commit hash, which comes right after the repository in urlParts, never
+// change and may be cached for good, others have to be revalidated.  Either
+// way the response depends on whether JSON was asked for in Accept.
+func WithETagCaching(handler func(*gin.Context, []string), etagFn func(*gin.Context, []string) string) func(*gin.Context, []string) {
+	return func(ctx *gin.Context, urlParts []string) {
+		etag := etagFn(ctx, urlParts)
+		if etag == "" {
+			handler(ctx, urlParts)
 			return
 		}
 
-		patchObj, err := parentCommit.Patch(commitObj)
-		patch = patchObj.String()
-	}
+		// The JSON and HTML versions of a page are different responses
+		if WantsJSON(ctx) {
+			etag += "-json"
+		}
+		etag = `"` + etag + `"`
+
+		ctx.Header("ETag", etag)
+		ctx.Writer.Header().Add("Vary", "Accept")
+		if len(urlParts) > 1 && plumbing.IsHash(urlParts[1]) {
+			ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			ctx.Header("Cache-Control", "no-cache")
+		}
 
-	commitHashStr := fmt.Sprintf("From %s Mon Sep 17 00:00:00 2001", commitObj.Hash)
-	from := fmt.Sprintf("From: %s <%s>", commitObj.Author.Name, commitObj.Author.Email)
-	date := fmt.Sprintf("Date: %s", commitObj.Author.When.Format(commitFormatDate))
-	subject := fmt.Sprintf("Subject: [PATCH] %s", commitObj.Message)
+		for _, match := range strings.Split(ctx.GetHeader("If-None-Match"), ",") {
+			match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+			if match == etag || match == "*" {
+				// The cached page carries the nonce of its own policy
+				ctx.Writer.Header().Del("Content-Security-Policy")
+				ctx.AbortWithStatus(http.StatusNotModified)
+				return
+			}
+		}
 
-	stats, err := commitObj.Stats()
-	if err != nil {
-		Http500(ctx)
-		return
+		handler(ctx, urlParts)
 	}
-
-	ctx.String(http.StatusOK, "%s\n%s\n%s\n%s\n---\n%s\n%s",
-		commitHashStr, from, date, subject, stats.String(), patch)
 }
 
-func CommitView(ctx *gin.Context, urlParts []string) {
-	repoName := urlParts[0]
-	smithyConfig := ctx.MustGet("config").(SmithyConfig)
-	repoPath := filepath.Join(smithyConfig.Git.Root, repoName)
+// hashETag turns the values a response depends on into an ETag
+func hashETag(values ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(values, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
 
-	repoPathExists, err := PathExists(repoPath)
+// configETag covers the settings that change how refs and log pages look,
+// so that cached pages are fetched again once they're changed and reloaded
+func configETag(config SmithyConfig) string {
+	return hashETag(config.Title, config.Description, config.Host, config.Prefix,
+		strconv.Itoa(config.Git.ShortHashLength), strconv.Itoa(config.Log.MaxSubjectLength),
+		strconv.Itoa(config.Log.MaxDepth), config.Tags.SortBy)
+}
 
-	if err != nil {
-		Http404(ctx)
-		return
-	}
+// renderETag adds the settings commit and file pages are rendered with to
+// configETag.  Those pages are cached for a year, so every setting that
+// changes them must be covered.
+func renderETag(config SmithyConfig) string {
+	values := []string{configETag(config),
+		strconv.Itoa(config.Diff.ContextLines), strconv.Itoa(config.Diff.MaxContextLines),
+		strconv.Itoa(config.Diff.MaxFileDiffBytes), strconv.Itoa(config.Blob.MaxSizeKB),
+		config.Highlight.Style, strconv.FormatBool(config.Highlight.InlineCSS),
+		strconv.FormatBool(config.Markdown.GenerateTOC),
+		string(config.customCSS), string(config.customJS)}
+	for _, pattern := range config.CommitLinkPatterns {
+		values = append(values, pattern.Regex, pattern.URL, pattern.Label)
+	}
+	return hashETag(values...)
+}
 
-	if !repoPathExists {
-		Http404(ctx)
-		return
+// refsETag changes whenever one of the repository's refs moves
+func refsETag(ctx *gin.Context, urlParts []string) string {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repo, exists := smithyConfig.FindRepo(urlParts[0])
+	if !exists {
+		return ""
 	}
 
-	r, err := git.PlainOpen(repoPath)
-
+	head, err := repo.Repository.Head()
 	if err != nil {
-		Http404(ctx)
-		return
-	}
-	commitID := urlParts[1]
-	if commitID == "" {
-		Http404(ctx)
-		return
+		return ""
 	}
-	commitHash := plumbing.NewHash(commitID)
-	commitObj, err := r.CommitObject(commitHash)
-
-	changes, err := GetChanges(commitObj)
 
+	refs, err := repo.Repository.References()
 	if err != nil {
-		Http404(ctx)
-		return
+		return ""
 	}
 
-	formattedChanges, err := FormatChanges(changes)
-
+	values := []string{urlParts[0], head.Hash().String(), configETag(smithyConfig)}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		values = append(values, ref.Name().String(), ref.Hash().String())
+		return nil
+	})
 	if err != nil {
-		Http404(ctx)
-		return
+		return ""
 	}
 
-	ctx.HTML(http.StatusOK, "commit.html", makeTemplateContext(smithyConfig, gin.H{
-		"RepoName": repoName,
-		"Commit":   commitObj,
-		"Changes":  template.HTML(formattedChanges),
-	}))
+	return hashETag(values...)
 }
 
-func ListBranches(r *git.Repository) ([]*plumbing.Reference, error) {
-	it, err := r.Branches()
-	if err != nil {
-		return []*plumbing.Reference{}, err
+// logETag changes whenever the logged ref moves.  The query string covers
+// the page, the view and the depth.
+func logETag(ctx *gin.Context, urlParts []string) string {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repo, exists := smithyConfig.FindRepo(urlParts[0])
+	if !exists {
+		return ""
 	}
 
-	return ReferenceCollector(it)
-}
-
-func ListTags(r *git.Repository) ([]*plumbing.Reference, error) {
-	it, err := r.Tags()
+	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(urlParts[1]))
 	if err != nil {
-		return []*plumbing.Reference{}, err
+		return ""
 	}
 
-	return ReferenceCollector(it)
+	values := append([]string{revision.String(), ctx.Request.URL.RawQuery, configETag(smithyConfig)}, urlParts...)
+	return hashETag(values...)
 }
 
-func ReferenceCollector(it storer.ReferenceIter) ([]*plumbing.Reference, error) {
-	var refs []*plumbing.Reference
+// commitETag changes with the hash of the commit a page shows, which only
+// needs to exist, and with the settings it is rendered with
+func commitETag(ctx *gin.Context, urlParts []string) string {
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repo, exists := smithyConfig.FindRepo(urlParts[0])
+	if !exists || !plumbing.IsHash(urlParts[1]) {
+		return ""
+	}
 
-	for {
-		b, err := it.Next()
+	hash := plumbing.NewHash(urlParts[1])
+	if repo.Repository.Storer.HasEncodedObject(hash) != nil {
+		return ""
+	}
 
-		if err == io.EOF {
-			break
-		}
+	return hashETag(hash.String(), ctx.Request.URL.RawQuery, renderETag(smithyConfig))
+}
 
-		if err != nil {
-			return refs, err
-		}
+// blobETag changes whenever the file a page shows does, or the settings it
+// is rendered with, directories aren't cached
+func blobETag(ctx *gin.Context, urlParts []string) string {
+	if len(urlParts) < 3 || urlParts[2] == "" {
+		return ""
+	}
 
-		refs = append(refs, b)
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+	repo, exists := smithyConfig.FindRepo(urlParts[0])
+	if !exists {
+		return ""
 	}
 
-	sort.Sort(ReferenceByName(refs))
-	return refs, nil
-}
+	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(urlParts[1]))
+	if err != nil {
+		return ""
+	}
 
-// Make the config available to every request
-func AddConfigMiddleware(cfg SmithyConfig) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Set("config", cfg)
+	commit, err := repo.Repository.CommitObject(*revision)
+	if err != nil {
+		return ""
 	}
-}
 
-// PatchHTML returns an HTML representation of a patch
-func PatchHTML(p object.Patch) string {
-	buf := bytes.NewBuffer(nil)
-	ue := NewUnifiedEncoder(buf, DefaultContextLines)
-	err := ue.Encode(p)
+	tree, err := commit.Tree()
 	if err != nil {
-		fmt.Println("PatchHTML error")
+		return ""
 	}
-	return buf.String()
+
+	entry, err := tree.FindEntry(urlParts[2])
+	if err != nil || !entry.Mode.IsFile() {
+		return ""
+	}
+
+	value := strings.Join([]string{urlParts[0], urlParts[1], urlParts[2], entry.Hash.String()}, ":")
+	if ctx.Request.URL.RawQuery != "" {
+		value += "?" + ctx.Request.URL.RawQuery
+	}
+	value += "\x00" + renderETag(smithyConfig)
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
 }
 
 type Route struct {
+	// Name identifies the route in metrics, routes showing the same page
+	// share it
+	Name    string
 	Pattern *regexp.Regexp
 	View    func(*gin.Context, []string)
 }
 
+// RepoSlugPattern matches repository slugs, which are one or more labels
+// separated by slashes, e.g. smithy or org/smithy
+const RepoSlugPattern = `[a-zA-Z0-9\-~\.]+(?:/[a-zA-Z0-9\-~\.]+)*?`
+
 func CompileRoutes() []Route {
 	// Label is either a repo, a ref
 	// A filepath is a list of labels
 	label := `[a-zA-Z0-9\-~\.]+`
 
+	// Repositories may be namespaced, the shortest slug that lets the rest
+	// of the route match wins
+	repoLabel := RepoSlugPattern
+
 	indexUrl := regexp.MustCompile(`^/$`)
-	repoGitUrl := regexp.MustCompile(`^/git/(?P<repo>` + label + `)`)
-	repoIndexUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)$`)
-	refsUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/refs$`)
-	logDefaultUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/log$`)
-	logUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/log/(?P<ref>` + label + `)$`)
-	commitUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/commit/(?P<commit>[a-z0-9]+)$`)
-	patchUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/commit/(?P<commit>[a-z0-9]+).patch`)
-
-	treeRootUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/tree$`)
-	treeRootRefUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/tree/(?P<ref>` + label + `)$`)
-	treeRootRefPathUrl := regexp.MustCompile(`^/(?P<repo>` + label + `)/tree/(?P<ref>` + label + `)/(?P<path>.*)$`)
+	livenessUrl := regexp.MustCompile(`^/healthz/live$`)
+	readinessUrl := regexp.MustCompile(`^/healthz/ready$`)
+	adminCacheFlushUrl := regexp.MustCompile(`^/admin/cache/flush$`)
+	repoGitUrl := regexp.MustCompile(`^/git/(?P<repo>` + repoLabel + `)/(?:info/refs|HEAD|git-upload-pack|git-receive-pack|objects/.*)$`)
+	repoIndexUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)$`)
+	refsUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/refs$`)
+	tagUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/tag/(?P<tag>` + label + `)$`)
+	logDefaultUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/log$`)
+	logUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/log/(?P<ref>` + label + `)$`)
+	logPathUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/log/(?P<ref>` + label + `)/(?P<path>.*)$`)
+	shortCommitUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/commit/(?P<commit>[0-9a-f]{4,39})$`)
+	commitUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/commit/(?P<commit>[a-z0-9]+)$`)
+	patchUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/commit/(?P<commit>[a-z0-9]+).patch`)
+	comparePatchUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/compare/(?P<from>` + label + `)\.\.\.(?P<to>` + label + `)\.patch$`)
+	compareUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/compare/(?P<from>` + label + `)\.\.\.(?P<to>` + label + `)$`)
+	ancestorsUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/commit/(?P<commit>[a-z0-9]+)/ancestors$`)
+
+	treeRootUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/tree$`)
+	treeRootRefUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/tree/(?P<ref>` + label + `)$`)
+	treeRootRefPathUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/tree/(?P<ref>` + label + `)/(?P<path>.*)$`)
+	rawFileUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/raw/(?P<ref>` + label + `)/(?P<path>.*)$`)
+	blameUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/blame/(?P<ref>` + label + `)/(?P<path>.*)$`)
+	repoStaticUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/static/(?P<path>.*)$`)
+	docsUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/docs/(?P<ref>` + label + `)(?:/(?P<path>.*))?$`)
+	activityUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/activity$`)
+	statsUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/stats$`)
+	commitsBatchUrl := regexp.MustCompile(`^/repos/(?P<repo>` + repoLabel + `)/commits/batch$`)
+	feedUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/feed\.(?P<format>atom|rss)$`)
+	infoRefsUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/info/refs$`)
+	uploadPackUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/git-upload-pack$`)
+	archiveUrl := regexp.MustCompile(`^/(?P<repo>` + repoLabel + `)/archive/(?P<ref>` + label + `)\.(?P<format>tar\.gz|zip)$`)
 
 	return []Route{
-		{Pattern: indexUrl, View: IndexView},
-		{Pattern: repoIndexUrl, View: RepoIndexView},
-		{Pattern: repoGitUrl, View: RepoGitView},
-		{Pattern: refsUrl, View: RefsView},
-		{Pattern: logDefaultUrl, View: LogViewDefault},
-		{Pattern: logUrl, View: LogView},
-		{Pattern: commitUrl, View: CommitView},
-		{Pattern: patchUrl, View: PatchView},
-		{Pattern: treeRootUrl, View: TreeView},
-		{Pattern: treeRootRefUrl, View: TreeView},
-		{Pattern: treeRootRefPathUrl, View: TreeView},
+		{Name: "index", Pattern: indexUrl, View: IndexView},
+		{Name: "liveness", Pattern: livenessUrl, View: LivenessView},
+		{Name: "readiness", Pattern: readinessUrl, View: ReadinessView},
+		{Name: "admin", Pattern: adminCacheFlushUrl, View: AdminCacheFlushView},
+		{Name: "commits_batch", Pattern: commitsBatchUrl, View: CommitsBatchView},
+		{Name: "repo_index", Pattern: repoIndexUrl, View: RepoIndexView},
+		{Name: "repo_git", Pattern: repoGitUrl, View: RepoGitView},
+		{Name: "refs", Pattern: refsUrl, View: WithETagCaching(RefsView, refsETag)},
+		{Name: "tag", Pattern: tagUrl, View: TagView},
+		{Name: "log", Pattern: logDefaultUrl, View: LogViewDefault},
+		{Name: "log", Pattern: logUrl, View: WithETagCaching(LogView, logETag)},
+		{Name: "log", Pattern: logPathUrl, View: WithETagCaching(LogView, logETag)},
+		{Name: "commit", Pattern: shortCommitUrl, View: ShortCommitView},
+		{Name: "commit", Pattern: commitUrl, View: WithETagCaching(CommitView, commitETag)},
+		{Name: "patch", Pattern: patchUrl, View: WithETagCaching(PatchView, commitETag)},
+		{Name: "ancestors", Pattern: ancestorsUrl, View: CommitAncestorsView},
+		{Name: "compare", Pattern: comparePatchUrl, View: ComparePatchView},
+		{Name: "compare", Pattern: compareUrl, View: CompareView},
+		{Name: "tree", Pattern: treeRootUrl, View: TreeView},
+		{Name: "tree", Pattern: treeRootRefUrl, View: TreeView},
+		{Name: "tree", Pattern: treeRootRefPathUrl, View: WithETagCaching(TreeView, blobETag)},
+		{Name: "raw", Pattern: rawFileUrl, View: WithETagCaching(RawFileView, blobETag)},
+		{Name: "blame", Pattern: blameUrl, View: BlameView},
+		{Name: "archive", Pattern: archiveUrl, View: ArchiveView},
+		{Name: "feed", Pattern: feedUrl, View: FeedView},
+		{Name: "activity", Pattern: activityUrl, View: ActivityView},
+		{Name: "stats", Pattern: statsUrl, View: StatsView},
+		{Name: "docs", Pattern: docsUrl, View: DocsView},
+		{Name: "repo_static", Pattern: repoStaticUrl, View: RepoStaticView},
+		{Name: "info_refs", Pattern: infoRefsUrl, View: InfoRefsView},
+		{Name: "upload_pack", Pattern: uploadPackUrl, View: UploadPackView},
 	}
 }
 
@@ -865,28 +3746,57 @@ func InitFileSystemHandler(smithyConfig SmithyConfig) http.Handler {
 }
 
 func Dispatch(ctx *gin.Context, routes []Route, fileSystemHandler http.Handler) {
-	urlPath := ctx.Request.URL.String()
+	urlPath := ctx.Request.URL.Path
 
 	smithyConfig := ctx.MustGet("config").(SmithyConfig)
 
 	if strings.HasPrefix(urlPath, smithyConfig.Static.Prefix) {
+		ctx.Set("route", "static")
 		fileSystemHandler.ServeHTTP(ctx.Writer, ctx.Request)
 		return
 	}
 
+	// The JSON API mirrors the pages below its prefix
+	if urlPath == APIv1Prefix || strings.HasPrefix(urlPath, APIv1Prefix+"/") {
+		ctx.Set("api", true)
+		urlPath = strings.TrimPrefix(urlPath, APIv1Prefix)
+		if urlPath == "" {
+			urlPath = "/"
+		}
+		ctx.Request.URL.Path = urlPath
+	}
+
 	for _, route := range routes {
 		if !route.Pattern.MatchString(urlPath) {
 			continue
 		}
 
+		matches := route.Pattern.FindStringSubmatch(urlPath)
+
+		// Only configured repositories are served, so that slugs like ".."
+		// can't reach outside the git root.  A namespaced repo that doesn't
+		// exist is more likely a shorter slug followed by a page of it,
+		// which a later route handles.
+		repoIndex := route.Pattern.SubexpIndex("repo")
+		if repoIndex > 0 {
+			if _, exists := smithyConfig.FindRepo(matches[repoIndex]); !exists {
+				continue
+			}
+		}
+
 		urlParts := []string{}
 
-		for i, match := range route.Pattern.FindStringSubmatch(urlPath) {
+		for i, match := range matches {
 			if i != 0 {
 				urlParts = append(urlParts, match)
 			}
 		}
 
+		ctx.Set("route", route.Name)
+		if repoIndex > 0 {
+			ctx.Set("repo", matches[repoIndex])
+		}
+
 		route.View(ctx, urlParts)
 		return
 
@@ -898,23 +3808,26 @@ func Dispatch(ctx *gin.Context, routes []Route, fileSystemHandler http.Handler)
 
 func loadTemplates(smithyConfig SmithyConfig) (*template.Template, error) {
 
-	cssPath := smithyConfig.Static.Prefix + "style.css"
+	cssPath := smithyConfig.Prefix + smithyConfig.Static.Prefix + "style.css"
 
 	funcs := template.FuncMap{
 		"css": func() string {
 			return cssPath
 		},
+		"prefix": func() string {
+			return smithyConfig.Prefix
+		},
+		"treeLink":      TreeLink,
+		"languageColor": LanguageColor,
+		"copyButton":    CopyButton,
+		"upstreamURL":   UpstreamURL,
+		"linkify": func(text string) template.HTML {
+			return Linkify(text, smithyConfig.CommitLinkPatterns)
+		},
 	}
 
 	t := template.New("").Funcs(funcs)
 
-	if smithyConfig.Templates.Dir != "" {
-		if !strings.HasSuffix(smithyConfig.Templates.Dir, "*") {
-			smithyConfig.Templates.Dir += "/*"
-		}
-		return t.ParseGlob(smithyConfig.Templates.Dir)
-	}
-
 	files, err := templatefiles.ReadDir("templates")
 
 	if err != nil {
@@ -922,9 +3835,6 @@ func loadTemplates(smithyConfig SmithyConfig) (*template.Template, error) {
 	}
 
 	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".html") {
-			continue
-		}
 		f, err := templatefiles.Open("templates/" + file.Name())
 		if err != nil {
 			return t, err
@@ -941,40 +3851,228 @@ func loadTemplates(smithyConfig SmithyConfig) (*template.Template, error) {
 
 	}
 
+	if smithyConfig.Templates.Dir == "" {
+		return t, nil
+	}
+
+	extensions := smithyConfig.Templates.Extensions
+	if len(extensions) == 0 {
+		extensions = []string{".html"}
+	}
+
+	// Templates in the directory replace the built-in ones of the same
+	// name.  Views look templates up by their .html name regardless of the
+	// extension they were loaded with.
+	dir := strings.TrimSuffix(smithyConfig.Templates.Dir, "*")
+	for _, ext := range extensions {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return t, err
+		}
+		for _, match := range matches {
+			contents, err := ioutil.ReadFile(match)
+			if err != nil {
+				return t, err
+			}
+			name := strings.TrimSuffix(filepath.Base(match), ext) + ".html"
+			_, err = t.New(name).Parse(string(contents))
+			if err != nil {
+				return t, err
+			}
+		}
+	}
+
 	return t, nil
 }
 
-func StartServer(cfgFilePath string, debug bool) {
-	config, err := LoadConfig(cfgFilePath)
+// headResponseWriter swallows the body of a response while keeping track of
+// how long it would have been, so that HEAD requests get the same headers as
+// their GET counterparts
+type headResponseWriter struct {
+	gin.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *headResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *headResponseWriter) WriteHeaderNow() {}
+
+func (w *headResponseWriter) Write(data []byte) (int, error) {
+	w.size += len(data)
+	return len(data), nil
+}
+
+func (w *headResponseWriter) WriteString(s string) (int, error) {
+	w.size += len(s)
+	return len(s), nil
+}
+
+func (w *headResponseWriter) Flush() {}
+
+func (w *headResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *headResponseWriter) Size() int {
+	return w.size
+}
+
+func (w *headResponseWriter) Written() bool {
+	return w.status != 0 || w.size > 0
+}
+
+// finish sends the headers that were held back during rendering
+func (w *headResponseWriter) finish() {
+	if w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(w.size))
+	}
+	w.ResponseWriter.WriteHeader(w.Status())
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func NewRouter(config SmithyConfig) (*gin.Engine, error) {
+	return NewReloadableRouter(NewConfigHolder(config))
+}
+
+// NewReloadableRouter serves requests with the configuration in holder.
+// Settings used to set the router up, such as the prefix, redirects and
+// templates, keep the values holder had at first.
+func NewReloadableRouter(holder *ConfigHolder) (*gin.Engine, error) {
+	config := holder.Get()
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	if config.Log.Format == LogFormatJSON {
+		router.Use(NewStructuredLogger())
+	} else {
+		router.Use(gin.Logger())
+	}
+	if config.Compression.Enabled {
+		router.Use(CompressionMiddleware(config.Compression))
+	}
+	router.Use(gin.Recovery())
+	loader, err := NewCachingTemplateLoader(config)
+	if err != nil {
+		return nil, err
+	}
+	router.HTMLRender = loader
+	router.Use(AddConfigMiddleware(holder))
+	router.Use(CSPNonceMiddleware())
+	router.Use(MaxRequestBodyMiddleware(config.MaxRequestBodyBytes))
+	// The HTTPS redirect is built from the path before the prefix is
+	// stripped from it
+	if config.ForceHTTPS {
+		router.Use(ForceHTTPSMiddleware(config.Host))
+	}
+	router.Use(PrefixMiddleware(config.Prefix))
+	if len(config.Redirects) > 0 {
+		router.Use(RedirectMiddleware(config.Redirects, config.Prefix))
+	}
+	if config.Metrics.Enabled {
+		router.Use(MetricsMiddleware())
+	}
+	if config.TLS.Enabled() && config.TLS.HTTP2 && config.TLS.ServerPush {
+		router.Use(ServerPushMiddleware(config))
+	}
+
+	fileSystemHandler := InitFileSystemHandler(config)
+	metricsHandler := gin.WrapH(promhttp.Handler())
+
+	routes := CompileRoutes()
+	handler := func(ctx *gin.Context) {
+		// gin can't have a route next to the catch-all one, so the metrics
+		// are looked for here, before any view
+		if config.Metrics.Enabled && ctx.Request.URL.Path == MetricsPath {
+			ctx.Set("route", "metrics")
+			metricsHandler(ctx)
+			return
+		}
+		Dispatch(ctx, routes, fileSystemHandler)
+	}
+
+	methods := []string{
+		http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions,
+		http.MethodTrace,
+	}
+	for _, method := range methods {
+		router.Handle(method, "*path", handler)
+	}
+
+	router.HEAD("*path", func(ctx *gin.Context) {
+		writer := &headResponseWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = writer
+		Dispatch(ctx, routes, fileSystemHandler)
+		writer.finish()
+	})
+
+	return router, nil
+}
+
+// StartServer serves the configuration at cfgFilePath, listenAddress and
+// unixSocket override its listen_address and unix_socket when they're not
+// empty
+func StartServer(cfgFilePath string, debug bool, listenAddress, unixSocket string) {
+	load := func() (SmithyConfig, error) {
+		config, err := LoadConfig(cfgFilePath)
+		if err != nil {
+			return config, err
+		}
+
+		if listenAddress != "" {
+			config.ListenAddress = listenAddress
+		}
+		if unixSocket != "" {
+			config.UnixSocket = unixSocket
+		}
+		return config, nil
+	}
+
+	config, err := load()
 
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	if config.UnixSocket != "" && config.TLS.Enabled() {
+		fmt.Println("unix_socket can't be used with tls, which needs a TCP port")
+		return
+	}
+
 	if !debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
-	templ, err := loadTemplates(config)
+	holder := NewConfigHolder(config)
+	router, err := NewReloadableRouter(holder)
 	if err != nil {
 		fmt.Println("Failed to load templates:", err)
 		return
 	}
-	router.SetHTMLTemplate(templ)
-	router.Use(AddConfigMiddleware(config))
 
-	fileSystemHandler := InitFileSystemHandler(config)
+	ReloadOnSIGHUP(holder, load)
 
-	routes := CompileRoutes()
-	router.Any("*path", func(ctx *gin.Context) {
-		Dispatch(ctx, routes, fileSystemHandler)
-	})
+	if err := WatchRepositories(holder); err != nil {
+		fmt.Println("Failed to watch the git root:", err)
+	}
 
-	err = router.Run(":" + fmt.Sprint(config.Port))
+	addr := config.Addr()
+	if config.UnixSocket != "" {
+		addr = config.UnixSocket
+		err = runUnixSocket(router, addr)
+	} else if config.TLS.Enabled() {
+		err = runTLS(router, config, addr)
+	} else {
+		err = router.Run(addr)
+	}
 
 	if err != nil {
-		fmt.Println("ERROR:", err, config.Port)
+		fmt.Println("ERROR:", err, addr)
 	}
 }
@@ -0,0 +1,2573 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/yaml.v2"
+)
+
+func newTestRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+// newTestRepoRouter serves a repository called demo holding a README and
+// returns the hash of its only commit
+func newTestRepoRouter(t *testing.T) (*gin.Engine, plumbing.Hash) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+
+	hash := newTestRepoAt(t, filepath.Join(config.Git.Root, "demo"))
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, hash
+}
+
+// newTestRepoAt creates a repository at dir with a README on master
+func newTestRepoAt(t *testing.T, dir string) plumbing.Hash {
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commitTestFiles(t, w, "Initial commit", time.Now(), map[string]string{"README": "hello"})
+}
+
+func TestShortCommitRedirect(t *testing.T) {
+	router, hash := newTestRepoRouter(t)
+
+	for _, length := range []int{8, 12} {
+		short := hash.String()[:length]
+		t.Run(short, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/demo/commit/"+short, nil))
+
+			if w.Code != http.StatusMovedPermanently {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+
+			want := "/demo/commit/" + hash.String()
+			if got := w.Header().Get("Location"); got != want {
+				t.Errorf("redirected to %q, want %q", got, want)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/demo/commit/00000000", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown short hash returned %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestResolveShortHashIgnoresRefs(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := commitTestFiles(t, w, "Initial commit", time.Now(), nil)
+
+	if strings.HasPrefix(commit.String(), "beef") {
+		t.Skip("the commit's hash starts with the branch name")
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("beef"), commit)); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, err := ResolveShortHash(r, "beef"); err != plumbing.ErrObjectNotFound {
+		t.Errorf("got %s, %v for a branch named like a hash, want %v", hash, err, plumbing.ErrObjectNotFound)
+	}
+
+	if hash, err := ResolveShortHash(r, commit.String()[:6]); err != nil || hash != commit {
+		t.Errorf("got %s, %v, want %s", hash, err, commit)
+	}
+}
+
+func TestCommitHashesFollowRefs(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), time.Now(), nil)
+
+		hashes, err := commitHashes(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != i {
+			t.Errorf("got %d hashes after %d commits", len(hashes), i)
+		}
+	}
+
+	commitHashCacheMutex.Lock()
+	cached := commitHashCache[repositoryPath(r)]
+	commitHashCacheMutex.Unlock()
+	if len(cached.hashes) != 2 {
+		t.Errorf("the cached list has %d hashes, want the latest one", len(cached.hashes))
+	}
+}
+
+func TestETagCaching(t *testing.T) {
+	router, hash := newTestRepoRouter(t)
+
+	tests := []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/demo/commit/" + hash.String(), "public, max-age=31536000, immutable"},
+		{"/demo/tree/" + hash.String() + "/README", "public, max-age=31536000, immutable"},
+		{"/demo/tree/master/README", "no-cache"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			etag := w.Header().Get("ETag")
+			if w.Code != http.StatusOK || etag == "" {
+				t.Fatalf("got status %d and ETag %q", w.Code, etag)
+			}
+
+			if got := w.Header().Get("Cache-Control"); got != test.cacheControl {
+				t.Errorf("Cache-Control is %q, want %q", got, test.cacheControl)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary is %q, want %q", got, "Accept")
+			}
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			r.Header.Set("If-None-Match", etag)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != http.StatusNotModified {
+				t.Errorf("If-None-Match returned %d, want %d", w.Code, http.StatusNotModified)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != "" {
+				t.Errorf("304 sent Content-Security-Policy %q, which doesn't match the cached page's nonce", got)
+			}
+		})
+	}
+}
+
+func TestConfigETag(t *testing.T) {
+	config := New()
+	etag := configETag(config)
+
+	for name, change := range map[string]func(*SmithyConfig){
+		"short_hash_length":  func(c *SmithyConfig) { c.Git.ShortHashLength = 12 },
+		"max_subject_length": func(c *SmithyConfig) { c.Log.MaxSubjectLength = 20 },
+		"max_depth":          func(c *SmithyConfig) { c.Log.MaxDepth = 500 },
+		"sort_by":            func(c *SmithyConfig) { c.Tags.SortBy = "date" },
+	} {
+		changed := New()
+		change(&changed)
+		if configETag(changed) == etag {
+			t.Errorf("changing %s didn't change the ETag", name)
+		}
+	}
+}
+
+func TestRenderETag(t *testing.T) {
+	config := New()
+	etag := renderETag(config)
+
+	for name, change := range map[string]func(*SmithyConfig){
+		"short_hash_length":    func(c *SmithyConfig) { c.Git.ShortHashLength = 12 },
+		"context_lines":        func(c *SmithyConfig) { c.Diff.ContextLines = 10 },
+		"max_file_diff_bytes":  func(c *SmithyConfig) { c.Diff.MaxFileDiffBytes = 1024 },
+		"style":                func(c *SmithyConfig) { c.Highlight.Style = "monokai" },
+		"commit_link_patterns": func(c *SmithyConfig) { c.CommitLinkPatterns = []LinkPattern{{Regex: "#[0-9]+"}} },
+		"custom_css":           func(c *SmithyConfig) { c.customCSS = "body {}" },
+		"custom_js":            func(c *SmithyConfig) { c.customJS = "alert(1)" },
+	} {
+		changed := New()
+		change(&changed)
+		if renderETag(changed) == etag {
+			t.Errorf("changing %s didn't change the ETag", name)
+		}
+	}
+}
+
+func TestOpenRepositoryWithEnv(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := commitTestFiles(t, w, "Initial commit", time.Now(), nil)
+
+	if err := os.Rename(filepath.Join(dir, ".git"), filepath.Join(dir, ".repo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenRepositoryWithEnv(dir); err == nil {
+		t.Fatal("opened a repository without .git while GIT_DIR is unset")
+	}
+
+	t.Setenv("GIT_DIR", ".repo")
+	r, err = OpenRepositoryWithEnv(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != hash {
+		t.Errorf("HEAD is %s, want %s", head.Hash(), hash)
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	router := newTestRouter(t)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(cancelled))
+
+	if w.Code != StatusClientClosedRequest || w.Body.Len() != 0 {
+		t.Errorf("got status %d and %d bytes for a cancelled request", w.Code, w.Body.Len())
+	}
+}
+
+func TestWithGitTimeout(t *testing.T) {
+	config := New()
+	config.Git.operationTimeout = 10 * time.Millisecond
+
+	stopped := make(chan error, 1)
+	err := config.WithGitTimeout(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return ctx.Err()
+	})
+	if err != ErrOperationTimeout {
+		t.Errorf("got %v, want %v", err, ErrOperationTimeout)
+	}
+
+	// The operation is told to stop once it's been given up on
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("the operation's context wasn't done after the timeout")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = config.WithGitTimeout(cancelled, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("got %v for a cancelled request, want %v", err, context.Canceled)
+	}
+}
+
+func TestShareGitOperation(t *testing.T) {
+	first, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := shareGitOperation(first, "test", func(ctx context.Context) (int, error) {
+			close(started)
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+		firstDone <- err
+	}()
+	<-started
+
+	second := make(chan int, 1)
+	go func() {
+		v, err := shareGitOperation(context.Background(), "test", func(ctx context.Context) (int, error) {
+			return 42, nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		second <- v
+	}()
+
+	// Give the second caller time to wait for the first one's operation
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-firstDone; err != context.Canceled {
+		t.Errorf("got %v for the cancelled caller, want %v", err, context.Canceled)
+	}
+	if v := <-second; v != 42 {
+		t.Errorf("got %d, want the other caller's cancellation not to be shared", v)
+	}
+}
+
+func TestHeadIndex(t *testing.T) {
+	router := newTestRouter(t)
+
+	get := httptest.NewRecorder()
+	router.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	head := httptest.NewRecorder()
+	router.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/", nil))
+
+	if head.Code != http.StatusOK {
+		t.Fatalf("HEAD / returned %d, want %d", head.Code, http.StatusOK)
+	}
+
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD / returned a body of %d bytes", head.Body.Len())
+	}
+
+	want := strconv.Itoa(get.Body.Len())
+	if got := head.Header().Get("Content-Length"); got != want {
+		t.Errorf("HEAD / Content-Length is %q, want %q", got, want)
+	}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var out bytes.Buffer
+	router := gin.New()
+	router.Use(RequestIDMiddleware(), newStructuredLogger(&out))
+	router.GET("/demo", func(ctx *gin.Context) {
+		ctx.Set("repo", "demo")
+		ctx.Status(http.StatusTeapot)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/demo", nil))
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q isn't JSON: %v", out.String(), err)
+	}
+
+	if entry.Method != http.MethodGet || entry.Path != "/demo" || entry.Status != http.StatusTeapot || entry.Repo != "demo" {
+		t.Errorf("got %+v", entry)
+	}
+
+	if id := w.Header().Get(RequestIDHeader); id == "" || id != entry.RequestID {
+		t.Errorf("X-Request-ID is %q, logged %q", id, entry.RequestID)
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	large := strings.Repeat("<p>diff</p>", 200)
+	router := gin.New()
+	router.Use(CompressionMiddleware(CompressionConfig{Enabled: true, Level: DefaultCompressionLevel, MinSize: 1024}))
+	router.GET("/large", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(large))
+	})
+	router.GET("/small", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<p>diff</p>"))
+	})
+	router.GET("/archive", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/zip", []byte(large))
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/large")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response wasn't compressed: %v", w.Header())
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != large {
+		t.Errorf("decompressed body differs from the original")
+	}
+
+	for _, path := range []string{"/small", "/archive"} {
+		w := get(path)
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s was compressed", path)
+		}
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s returned %d with %d bytes", path, w.Code, w.Body.Len())
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(2, 0)
+	cache.Add("a", "1")
+	cache.Add("b", "2")
+
+	// a was used last, so b is evicted for c
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	cache.Add("c", "3")
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("b wasn't evicted")
+	}
+
+	renders := 0
+	for i := 0; i < 2; i++ {
+		value, err := cache.GetOrRender("d", func() (string, error) {
+			renders++
+			return "4", nil
+		})
+		if err != nil || value != "4" {
+			t.Fatalf("got %q, %v", value, err)
+		}
+	}
+	if renders != 1 {
+		t.Errorf("rendered %d times, want once", renders)
+	}
+
+	if n := cache.Flush(); n != 2 {
+		t.Errorf("flushed %d entries, want 2", n)
+	}
+	if _, ok := cache.Get("d"); ok {
+		t.Error("d is still cached after a flush")
+	}
+
+	expiring := NewCache(10, time.Nanosecond)
+	expiring.Add("a", "1")
+	time.Sleep(time.Millisecond)
+	if _, ok := expiring.Get("a"); ok {
+		t.Error("a outlived its TTL")
+	}
+}
+
+// commitTestFiles writes and stages files in w, then commits them as
+// Tester at when
+func commitTestFiles(t *testing.T, w *git.Worktree, message string, when time.Time, files map[string]string) plumbing.Hash {
+	for name, contents := range files {
+		if err := util.WriteFile(w.Filesystem, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := w.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "Tester", Email: "tester@example.com", When: when},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// newTestPatch creates an in-memory repository with a commit holding from
+// and another one holding to, and returns the patch between them
+func newTestPatch(t *testing.T, from, to map[string]string) *object.Patch {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := r.CommitObject(commitTestFiles(t, w, "Before", time.Now(), from))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			if _, err := w.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	second, err := r.CommitObject(commitTestFiles(t, w, "After", time.Now(), to))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch, err := first.Patch(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch
+}
+
+// newTestCommit creates an in-memory repository holding files and returns
+// the commit that added them
+func newTestCommit(t *testing.T, files map[string]string) *object.Commit {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := commitTestFiles(t, w, "Initial commit", time.Now(), files)
+
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestGetReadmeFromCommit(t *testing.T) {
+	names := []string{
+		"README.md",
+		"README",
+		"README.markdown",
+		"readme.md",
+		"readme.markdown",
+		"readme",
+		"README.org",
+		"readme.org",
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			commit := newTestCommit(t, map[string]string{
+				name:      "# Hello",
+				"main.go": "package main",
+			})
+
+			readme, err := GetReadmeFromCommit(commit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if readme.Name != name {
+				t.Errorf("got %q, want %q", readme.Name, name)
+			}
+		})
+	}
+}
+
+func TestGetReadmeFromCommitMissing(t *testing.T) {
+	commit := newTestCommit(t, map[string]string{
+		"main.go":     "package main",
+		"README.txt":  "not a supported name",
+		"docs/README": "not at the root",
+	})
+
+	_, err := GetReadmeFromCommit(commit)
+	if err == nil || err.Error() != "no valid readme" {
+		t.Errorf("got error %v, want \"no valid readme\"", err)
+	}
+}
+
+func TestRenderReadme(t *testing.T) {
+	org := "* Hello\n/Some/ text\n#+HTML: <script>alert(1)</script>\n#+INCLUDE: \"/etc/passwd\"\n"
+	out := RenderReadme("README.org", org, MarkdownConfig{})
+
+	if !strings.Contains(out, "Hello\n</h2>") || !strings.Contains(out, "<em>Some</em>") {
+		t.Errorf("README.org wasn't rendered as Org-mode: %s", out)
+	}
+
+	if strings.Contains(out, "<script>") || strings.Contains(out, "root:") {
+		t.Errorf("README.org rendered raw HTML or an included file: %s", out)
+	}
+
+	org = "[[javascript:alert(1)][click]] [[JavaScript:alert(1)]] [[https://example.com][site]]\n"
+	out = RenderReadme("README.org", org, MarkdownConfig{})
+	if strings.Contains(strings.ToLower(out), `href="javascript`) {
+		t.Errorf("README.org rendered a javascript: link: %s", out)
+	}
+	if !strings.Contains(out, `<a href="https://example.com">site</a>`) || !strings.Contains(out, "click") {
+		t.Errorf("README.org dropped a safe link or link text: %s", out)
+	}
+
+	out = RenderReadme("README", "# Hello", MarkdownConfig{})
+	if out != "<h1>Hello</h1>\n" {
+		t.Errorf("got %q, want Markdown", out)
+	}
+}
+
+func TestGetLicenseFromCommit(t *testing.T) {
+	for _, name := range []string{"LICENSE", "LICENSE.md", "LICENCE.txt", "COPYING"} {
+		t.Run(name, func(t *testing.T) {
+			commit := newTestCommit(t, map[string]string{
+				name:        "GPL",
+				"README.md": "# Hello",
+			})
+
+			license, err := GetLicenseFromCommit(commit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if license.Name != name {
+				t.Errorf("got %q, want %q", license.Name, name)
+			}
+		})
+	}
+}
+
+func TestGetChangelogFromCommit(t *testing.T) {
+	commit := newTestCommit(t, map[string]string{
+		"CHANGES":      "1.0",
+		"CHANGELOG.md": "# 1.0",
+	})
+
+	changelog, err := GetChangelogFromCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changelog.Name != "CHANGELOG.md" {
+		t.Errorf("got %q, want %q", changelog.Name, "CHANGELOG.md")
+	}
+}
+
+func TestGetLicenseFromCommitMissing(t *testing.T) {
+	commit := newTestCommit(t, map[string]string{
+		"main.go":      "package main",
+		"docs/LICENSE": "not at the root",
+	})
+
+	_, err := GetLicenseFromCommit(commit)
+	if err == nil || err.Error() != "no valid license" {
+		t.Errorf("got error %v, want \"no valid license\"", err)
+	}
+}
+
+// fakeReferenceIter hands out refs and then fails with err
+type fakeReferenceIter struct {
+	refs []*plumbing.Reference
+	err  error
+}
+
+func (it *fakeReferenceIter) Next() (*plumbing.Reference, error) {
+	if len(it.refs) == 0 {
+		return nil, it.err
+	}
+	ref := it.refs[0]
+	it.refs = it.refs[1:]
+	return ref, nil
+}
+
+func (it *fakeReferenceIter) ForEach(cb func(*plumbing.Reference) error) error {
+	for {
+		ref, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if err := cb(ref); err != nil {
+			return err
+		}
+	}
+}
+
+func (it *fakeReferenceIter) Close() {}
+
+func TestReferenceCollectorEmpty(t *testing.T) {
+	refs, err := ReferenceCollector(&fakeReferenceIter{err: io.EOF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refs == nil {
+		t.Error("got a nil slice, want an empty one")
+	}
+
+	if len(refs) != 0 {
+		t.Errorf("got %d refs, want 0", len(refs))
+	}
+}
+
+func TestReferenceCollectorError(t *testing.T) {
+	failure := errors.New("corrupt packed-refs")
+	it := &fakeReferenceIter{
+		refs: []*plumbing.Reference{
+			plumbing.NewHashReference("refs/heads/main", plumbing.ZeroHash),
+			plumbing.NewHashReference("refs/heads/dev", plumbing.ZeroHash),
+		},
+		err: failure,
+	}
+
+	refs, err := ReferenceCollector(it)
+	if err != failure {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+
+	if len(refs) != 2 {
+		t.Fatalf("got %d refs, want the 2 read before the error", len(refs))
+	}
+
+	if refs[0].Name() != "refs/heads/main" || refs[1].Name() != "refs/heads/dev" {
+		t.Errorf("got %v and %v", refs[0].Name(), refs[1].Name())
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HEAD points at master, which doesn't exist yet
+	if got := DefaultBranch(r, nil); got != "" {
+		t.Errorf("got %q for an empty repository", got)
+	}
+
+	main := plumbing.NewHashReference("refs/heads/main", plumbing.ZeroHash)
+	if err := r.Storer.SetReference(main); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := DefaultBranch(r, nil); got != "main" {
+		t.Errorf("got %q, want main", got)
+	}
+
+	if got := DefaultBranch(r, &RepoConfig{DefaultBranch: "stable"}); got != "stable" {
+		t.Errorf("got %q, want the configured stable", got)
+	}
+
+	for _, ref := range []*plumbing.Reference{
+		plumbing.NewHashReference("refs/heads/dev", plumbing.ZeroHash),
+		plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/dev"),
+	} {
+		if err := r.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := DefaultBranch(r, &RepoConfig{}); got != "dev" {
+		t.Errorf("got %q, want dev from HEAD", got)
+	}
+}
+
+func TestLoadAllRepositoriesDefaultBranch(t *testing.T) {
+	config := New()
+	config.Git.Root = t.TempDir()
+
+	r, err := git.PlainInit(filepath.Join(config.Git.Root, "demo"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := commitTestFiles(t, w, "Initial commit", time.Now(), nil)
+
+	trunk := plumbing.NewBranchReferenceName("trunk")
+	if err := r.Storer.SetReference(plumbing.NewHashReference(trunk, hash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, trunk)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, exists := config.FindRepo("demo")
+	if !exists {
+		t.Fatal("demo wasn't loaded")
+	}
+	if repo.Meta.DefaultBranch != "trunk" {
+		t.Errorf("default branch is %q, want %q", repo.Meta.DefaultBranch, "trunk")
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/demo/log", nil))
+	if got := rec.Header().Get("Location"); got != "/demo/log/trunk" {
+		t.Errorf("/demo/log redirected to %q, want %q", got, "/demo/log/trunk")
+	}
+}
+
+func TestGetTagDetails(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := commitTestFiles(t, w, "Initial commit", time.Now(), nil)
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagger := &object.Signature{Name: "Tagger", Email: "tagger@example.com", When: time.Unix(1600000000, 0)}
+	annotated, err := r.CreateTag("v1.0", commit.Hash, &git.CreateTagOptions{Tagger: tagger, Message: "First release"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lightweight, err := r.CreateTag("nightly", commit.Hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details := GetTagDetails(r, []*plumbing.Reference{annotated, lightweight})
+
+	want := TagDetail{
+		Name:        "v1.0",
+		IsAnnotated: true,
+		Message:     "First release\n",
+		TaggerName:  "Tagger",
+		TaggerDate:  tagger.When,
+		Target:      commit.Hash,
+	}
+	if got := details[0]; got.Name != want.Name || got.IsAnnotated != want.IsAnnotated || got.Message != want.Message ||
+		got.TaggerName != want.TaggerName || !got.TaggerDate.Equal(want.TaggerDate) || got.Target != want.Target {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := details[1]; got.Name != "nightly" || got.IsAnnotated || got.Target != commit.Hash {
+		t.Errorf("got %+v for a lightweight tag", got)
+	}
+}
+
+func TestSetLastModified(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(name, contents, message string) plumbing.Hash {
+		return commitTestFiles(t, w, message, time.Now(), map[string]string{name: contents})
+	}
+
+	first := commit("README", "hello", "Add the README")
+	commit("src/main.go", "package main", "Add main")
+	last := commit("src/main.go", "package main\n", "Change main")
+
+	entries := []TreeEntry{{Name: "README"}, {Name: "src"}}
+	if err := SetLastModified(context.Background(), r, last, "", entries, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]plumbing.Hash{"README": first, "src": last}
+	for _, entry := range entries {
+		if entry.LastModified == nil {
+			t.Errorf("%s has no last commit", entry.Name)
+			continue
+		}
+		if got := entry.LastModified.Commit.Hash; got != want[entry.Name] {
+			t.Errorf("%s was last modified by %s, want %s", entry.Name, got, want[entry.Name])
+		}
+	}
+}
+
+func TestFirstParentIterShallow(t *testing.T) {
+	storage := memory.NewStorage()
+	r, err := git.Init(storage, memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []plumbing.Hash
+	for i := 0; i < 3; i++ {
+		hash := commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), time.Now(), map[string]string{"file.txt": strconv.Itoa(i)})
+		hashes = append(hashes, hash)
+	}
+
+	// Cut the history off below the second commit, like a shallow clone
+	delete(storage.ObjectStorage.Objects, hashes[0])
+	delete(storage.ObjectStorage.Commits, hashes[0])
+	if err := storage.SetShallow([]plumbing.Hash{hashes[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := newLogIter(r, hashes[2], "first-parent", "", true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	var got []plumbing.Hash
+	err = iter.ForEach(func(c *object.Commit) error {
+		got = append(got, c.Hash)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []plumbing.Hash{hashes[2], hashes[1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLogMaxDepth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.Log.MaxDepth = PAGE_SIZE
+
+	r, err := git.PlainInit(filepath.Join(config.Git.Root, "demo"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rare.txt is only touched by the oldest commit
+	if err := util.WriteFile(w.Filesystem, "rare.txt", []byte("rare"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("rare.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, like the log
+	var hashes []plumbing.Hash
+	for i := 0; i < PAGE_SIZE+50; i++ {
+		hash := commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), time.Unix(int64(i), 0), map[string]string{"file.txt": strconv.Itoa(i)})
+		hashes = append([]plumbing.Hash{hash}, hashes...)
+	}
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type graph struct {
+		Commits   []GraphNode
+		Next      string
+		Truncated bool
+	}
+
+	get := func(url string) graph {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", url, w.Code)
+		}
+
+		var page graph
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	// A full first page reaches the limit, so there's no next page
+	page := get("/demo/log/master?view=graph")
+	if len(page.Commits) != PAGE_SIZE || page.Next != "" || !page.Truncated {
+		t.Errorf("first page: got %d commits, next %q, truncated %v", len(page.Commits), page.Next, page.Truncated)
+	}
+
+	// The depth of a later page is counted, not taken from the query
+	page = get("/demo/log/master?view=graph&after=" + hashes[PAGE_SIZE-10].String() + "&depth=0")
+	if len(page.Commits) != 10 || !page.Truncated {
+		t.Errorf("later page: got %d commits, truncated %v", len(page.Commits), page.Truncated)
+	}
+
+	// The log of a file counts the commits it walks, not the ones it lists
+	page = get("/demo/log/master/rare.txt?view=graph")
+	if len(page.Commits) != 0 || !page.Truncated {
+		t.Errorf("file log: got %d commits, truncated %v", len(page.Commits), page.Truncated)
+	}
+}
+
+func TestLoadBlameIgnoreRevs(t *testing.T) {
+	a := strings.Repeat("a", 40)
+	b := strings.Repeat("b", 40)
+
+	commit := newTestCommit(t, map[string]string{
+		BlameIgnoreRevsFile: "# Reformatting\n" + a + "\n\n  " + b + "  # trailing comment\nnot-a-hash\n" + a[:7] + "\n",
+	})
+
+	hashes, err := LoadBlameIgnoreRevs(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []plumbing.Hash{plumbing.NewHash(a), plumbing.NewHash(b)}
+	if !reflect.DeepEqual(hashes, want) {
+		t.Errorf("got %v, want %v", hashes, want)
+	}
+
+	hashes, err = LoadBlameIgnoreRevs(newTestCommit(t, map[string]string{"README": "hello"}))
+	if err != nil || hashes != nil {
+		t.Errorf("without the file: got %v, %v", hashes, err)
+	}
+}
+
+func TestLineMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []int
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", []int{0, 1}},
+		{"inserted", "a\nb\n", "a\nnew\nb\n", []int{0, -1, 1}},
+		{"deleted", "a\nb\nc\n", "a\nc\n", []int{0, 2}},
+		{"replaced", "a\nb\nc\nd\n", "a\nB\nC\nD\nd\n", []int{0, 1, 2, -1, 3}},
+		{"empty", "", "a\n", []int{-1}},
+	}
+
+	for _, test := range tests {
+		if got := lineMapping(test.from, test.to); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBlameIgnoringRevs(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []plumbing.Hash
+	for i, contents := range []string{"a\nb\n", "a\nb\nc\n", "A\nB\nC\n"} {
+		hash := commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), time.Unix(int64(i), 0), map[string]string{"file.txt": contents})
+		hashes = append(hashes, hash)
+	}
+
+	commit, err := r.CommitObject(hashes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Looking through the last commit, which changed every line
+	lines, err := BlameIgnoringRevs(r, commit, "file.txt", []plumbing.Hash{hashes[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []plumbing.Hash{hashes[0], hashes[0], hashes[1]}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if line.Hash != want[i] {
+			t.Errorf("line %d: got %s, want %s", i, line.Hash, want[i])
+		}
+		if line.Text != strings.ToUpper(line.Text) {
+			t.Errorf("line %d: got text %q from an older commit", i, line.Text)
+		}
+	}
+}
+
+func TestValidSlug(t *testing.T) {
+	tests := map[string]bool{
+		"smithy":        true,
+		"org/smithy":    true,
+		"org/sub/repo":  true,
+		"repo.git":      true,
+		"":              false,
+		"org/":          false,
+		"/smithy":       false,
+		"org//smithy":   false,
+		"..":            false,
+		"org/../smithy": false,
+		"org/./smithy":  false,
+		"has space":     false,
+	}
+
+	for slug, want := range tests {
+		if got := ValidSlug(slug); got != want {
+			t.Errorf("%q: got %v, want %v", slug, got, want)
+		}
+	}
+}
+
+func TestDiscoverRepositories(t *testing.T) {
+	config := New()
+	config.Git.Root = t.TempDir()
+
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "flat"))
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "org", "nested"))
+	for _, dir := range []string{"empty", filepath.Join("org", "not-a-repo")} {
+		if err := os.MkdirAll(filepath.Join(config.Git.Root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos, err := config.discoverRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	want := []string{"flat", "org/nested"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestNamespacedRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "flat"))
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "org", "nested"))
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]int{
+		"/flat":                                             http.StatusOK,
+		"/flat/log/master":                                  http.StatusOK,
+		"/flat/tree/master/README":                          http.StatusOK,
+		"/org/nested":                                       http.StatusOK,
+		"/org/nested/refs":                                  http.StatusOK,
+		"/org/nested/log/master":                            http.StatusOK,
+		"/org/nested/log/master/README":                     http.StatusOK,
+		"/org/nested/tree/master/README":                    http.StatusOK,
+		"/org/nested/raw/master/README":                     http.StatusOK,
+		"/git/org/nested/info/refs?service=git-upload-pack": http.StatusOK,
+		"/git/flat/info/refs?service=git-upload-pack":       http.StatusOK,
+		"/org":                    http.StatusNotFound,
+		"/org/missing":            http.StatusNotFound,
+		"/org/missing/log/master": http.StatusNotFound,
+	}
+
+	for url, want := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", url, w.Code, want)
+		}
+	}
+
+	// The archive's name can't contain the slug's slash
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/org/nested/archive/master.zip", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("archive: got %d", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="org-nested-master.zip"`; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/org/nested/archive/master.tar.gz", nil)
+	router.ServeHTTP(w, req)
+	if got, want := w.Header().Get("Content-Type"), "application/gzip"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+}
+
+func TestIndexDisplayName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, layout := range []string{"table", "card", "compact"} {
+		config := New()
+		config.Git.Root = t.TempDir()
+		config.Git.Repos = []RepoConfig{{Slug: "myproject", Title: "My Project"}}
+		config.Index.Layout = layout
+		config.Index.ShowSlug = true
+
+		newTestRepoAt(t, filepath.Join(config.Git.Root, "myproject"))
+
+		if err := config.LoadAllRepositories(); err != nil {
+			t.Fatal(err)
+		}
+		router, err := NewRouter(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		router.ServeHTTP(w, req)
+
+		if want := `<a href="/myproject">My Project (myproject)</a>`; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s layout doesn't show %s", layout, want)
+		}
+	}
+}
+
+func TestWatchRepositoriesFollowsRoot(t *testing.T) {
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.Git.Watch = true
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+
+	holder := NewConfigHolder(config)
+	if err := WatchRepositories(holder); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload with another git root
+	root := t.TempDir()
+	err := holder.Update(func(config SmithyConfig) (SmithyConfig, error) {
+		config.Git.Root = root
+		err := config.LoadAllRepositories()
+		return config, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the watcher time to move to the new root
+	time.Sleep(100 * time.Millisecond)
+	newTestRepoAt(t, filepath.Join(root, "late"))
+
+	deadline := time.Now().Add(WatchSettleTime + 5*time.Second)
+	for time.Now().Before(deadline) {
+		config := holder.Get()
+		if _, exists := config.FindRepo("late"); exists {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("the repository added to the new git root wasn't loaded")
+}
+
+func TestActivityCacheBounded(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "demo")
+	newTestRepoAt(t, dir)
+
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		hash := commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), now, nil)
+		commit, err := r.CommitObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		activity, err := ComputeActivity(context.Background(), r, commit, ActivityPeriodWeek, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := activity.Counts[len(activity.Counts)-1]; got != i+2 {
+			t.Errorf("commit %d: got %d commits this week, want %d", i, got, i+2)
+		}
+	}
+
+	activityCacheMutex.Lock()
+	defer activityCacheMutex.Unlock()
+
+	entries := 0
+	for slot := range activityCache {
+		if slot.path == repositoryPath(r) {
+			entries++
+		}
+	}
+	if entries != 1 {
+		t.Errorf("got %d cached entries for the repository, want 1", entries)
+	}
+}
+
+func TestDetectLanguages(t *testing.T) {
+	config := New()
+
+	var repos []RepositoryWithName
+	want := map[string]string{}
+	for _, test := range []struct{ name, file, language string }{
+		{"go", "main.go", "Go"},
+		{"python", "main.py", "Python"},
+		{"rust", "main.rs", "Rust"},
+	} {
+		r, err := git.PlainInit(filepath.Join(t.TempDir(), test.name), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := r.Worktree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitTestFiles(t, w, "Initial commit", time.Now(), map[string]string{test.file: "x"})
+		repos = append(repos, RepositoryWithName{Name: test.name, Repository: r})
+		want[test.name] = test.language
+	}
+
+	// Without any time to wait the languages are detected in the background
+	start := time.Now()
+	DetectLanguages(config, repos, 0)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s without any time to wait", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := DetectLanguages(config, repos, 0)
+		languageCacheMutex.Lock()
+		pending := len(languagePending)
+		languageCacheMutex.Unlock()
+		if reflect.DeepEqual(got, want) && pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v with %d pending, want %v", got, pending, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLanguageCacheBounded(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "demo")
+	newTestRepoAt(t, dir)
+
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	languageCacheMutex.Lock()
+	before := len(languageCache)
+	languageCacheMutex.Unlock()
+
+	for i, want := range []string{"Go", "Python"} {
+		files := map[string]string{}
+		for j := 0; j <= i; j++ {
+			files[fmt.Sprintf("file%d-%d.%s", i, j, map[string]string{"Go": "go", "Python": "py"}[want])] = "x"
+		}
+		commitTestFiles(t, w, fmt.Sprintf("Commit %d", i), time.Now(), files)
+
+		language, err := DetectPrimaryLanguage(context.Background(), r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if language != want {
+			t.Errorf("commit %d: got %q, want %q", i, language, want)
+		}
+	}
+
+	languageCacheMutex.Lock()
+	defer languageCacheMutex.Unlock()
+
+	if got := len(languageCache) - before; got != 1 {
+		t.Errorf("got %d cached languages for the repository, want 1", got)
+	}
+}
+
+func TestParseQueryParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type params struct {
+		Name    string `query:"name"`
+		Verbose bool   `query:"verbose"`
+		PerPage int    `query:"per_page" min:"1" max:"100"`
+		Ignored int
+	}
+	defaults := params{Name: "default", PerPage: 20, Ignored: 7}
+
+	tests := []struct {
+		query string
+		want  params
+	}{
+		{"", defaults},
+		{"name=smithy&verbose=true&per_page=100", params{Name: "smithy", Verbose: true, PerPage: 100, Ignored: 7}},
+		{"per_page=1&Ignored=3", params{Name: "default", PerPage: 1, Ignored: 7}},
+	}
+
+	for _, test := range tests {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/?"+test.query, nil)
+
+		got, err := ParseQueryParams(ctx, defaults)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.query, got, test.want)
+		}
+	}
+
+	field, _ := reflect.TypeOf(params{}).FieldByName("PerPage")
+	invalid := map[string]string{
+		"many": "per_page must be a number",
+		"0":    "per_page must be at least 1",
+		"101":  "per_page must be at most 100",
+	}
+	for raw, want := range invalid {
+		var n int
+		err := setQueryParam(reflect.ValueOf(&n).Elem(), field, "per_page", raw)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %q", raw, err, want)
+		}
+	}
+
+	var b bool
+	field, _ = reflect.TypeOf(params{}).FieldByName("Verbose")
+	if err := setQueryParam(reflect.ValueOf(&b).Elem(), field, "verbose", "maybe"); err == nil {
+		t.Error("verbose=maybe was accepted")
+	}
+}
+
+func TestParseQueryParamsResponse(t *testing.T) {
+	router, _ := newTestRepoRouter(t)
+
+	// Browsers get the error page
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/?page=first", nil)
+	req.Header.Set("Accept", "text/html")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "page must be a number") {
+		t.Errorf("got %q: %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	// JSON clients get a JSON error
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/?page=first", nil)
+	req.Header.Set("Accept", "application/json")
+	router.ServeHTTP(w, req)
+
+	var body APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || body.Error != "page must be a number" {
+		t.Errorf("got %d %+v", w.Code, body)
+	}
+}
+
+func TestParseDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		contents string
+		want     []Dependency
+		wantErr  bool
+	}{
+		{
+			name:     "go.mod",
+			manifest: "go.mod",
+			contents: "module example.com/demo\n\ngo 1.18\n\nrequire (\n\tgithub.com/gin-gonic/gin v1.7.7\n\tgolang.org/x/mod v0.5.1 // indirect\n)\n\nrequire gopkg.in/yaml.v2 v2.4.0\n",
+			want: []Dependency{
+				{Name: "github.com/gin-gonic/gin", Version: "v1.7.7", Kind: DependencyDirect},
+				{Name: "golang.org/x/mod", Version: "v0.5.1", Kind: DependencyIndirect},
+				{Name: "gopkg.in/yaml.v2", Version: "v2.4.0", Kind: DependencyDirect},
+			},
+		},
+		{
+			name:     "go.mod without requirements",
+			manifest: "go.mod",
+			contents: "module example.com/demo\n",
+			want:     []Dependency{},
+		},
+		{
+			name:     "malformed go.mod",
+			manifest: "go.mod",
+			contents: "module example.com/demo\nrequire (\n\tgithub.com/gin-gonic/gin\n",
+			wantErr:  true,
+		},
+		{
+			name:     "requirements.txt",
+			manifest: "requirements.txt",
+			contents: "# Web\nDjango==4.0.1\nrequests[security] >= 2.0  # HTTP\n\n-r dev.txt\n--index-url https://example.com\nnumpy\npkg<2,>=1\ncompat===1.0\nwin-only ; sys_platform == 'win32'\n",
+			want: []Dependency{
+				{Name: "Django", Version: "==4.0.1", Kind: DependencyDirect},
+				{Name: "requests[security]", Version: ">= 2.0", Kind: DependencyDirect},
+				{Name: "numpy", Version: "", Kind: DependencyDirect},
+				{Name: "pkg", Version: "<2,>=1", Kind: DependencyDirect},
+				{Name: "compat", Version: "===1.0", Kind: DependencyDirect},
+				{Name: "win-only", Version: "", Kind: DependencyDirect},
+			},
+		},
+		{
+			name:     "empty requirements.txt",
+			manifest: "requirements.txt",
+			contents: "\n# nothing\n",
+			want:     []Dependency{},
+		},
+		{
+			name:     "package.json",
+			manifest: "package.json",
+			contents: `{"name": "demo", "dependencies": {"react": "^18.0.0", "axios": "1.2.0"}, "devDependencies": {"jest": "^29.0.0"}}`,
+			want: []Dependency{
+				{Name: "axios", Version: "1.2.0", Kind: DependencyDirect},
+				{Name: "react", Version: "^18.0.0", Kind: DependencyDirect},
+				{Name: "jest", Version: "^29.0.0", Kind: DependencyDev},
+			},
+		},
+		{
+			name:     "package.json without dependencies",
+			manifest: "package.json",
+			contents: `{"name": "demo"}`,
+			want:     []Dependency{},
+		},
+		{
+			name:     "malformed package.json",
+			manifest: "package.json",
+			contents: `{"dependencies": {"react": "^18.0.0",}`,
+			wantErr:  true,
+		},
+		{
+			name:     "package.json with a version that isn't a string",
+			manifest: "package.json",
+			contents: `{"dependencies": {"react": 18}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown manifest",
+			manifest: "Makefile",
+			contents: "all:\n",
+			want:     nil,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ParseDependencies(test.manifest, []byte(test.contents))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRawFileHeaders(t *testing.T) {
+	router, _ := newTestRepoRouter(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/demo/raw/master/README", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("got X-Content-Type-Options %q", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "sandbox" {
+		t.Errorf("got Content-Security-Policy %q", got)
+	}
+}
+
+// pushRecorder is an httptest.ResponseRecorder that records server pushes
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func TestServerPush(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.TLS.CertFile = "cert.pem"
+	config.TLS.KeyFile = "key.pem"
+	config.TLS.HTTP2 = true
+	config.TLS.ServerPush = true
+
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "demo"))
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"/":                        true,
+		"/demo":                    true,
+		"/demo/refs":               true,
+		"/missing":                 true,
+		"/demo/raw/master/README":  false,
+		"/demo/archive/master.zip": false,
+		"/demo/feed.atom":          false,
+		"/git/demo/info/refs?service=git-upload-pack": false,
+		"/demo?format=json":                           false,
+	}
+
+	for url, want := range tests {
+		w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		if got := len(w.pushed) > 0; got != want {
+			t.Errorf("%s: got pushed %v, want %v", url, w.pushed, want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	contents := `port: not-a-port
+git:
+  root: ` + filepath.Join(dir, "missing") + `
+tags:
+  sort_by: size
+log:
+  format: xml
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ValidateConfig(path)
+
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	all := strings.Join(msgs, "\n")
+
+	for _, want := range []string{"not-a-port", "tag sort order", "log format", "git.root"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("no error mentions %q in:\n%s", want, all)
+		}
+	}
+
+	// LoadConfig still stops at the first problem
+	if _, err := LoadConfig(path); err == nil || err.Error() != msgs[0] {
+		t.Errorf("got %v from LoadConfig, want %s", err, msgs[0])
+	}
+
+	if err := os.WriteFile(path, []byte("port: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := ValidateConfig(path); len(errs) != 1 {
+		t.Errorf("got %v for invalid YAML, want one error", errs)
+	}
+}
+
+func TestInfoRefsGitDirEnv(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+
+	dir := filepath.Join(config.Git.Root, "demo")
+	newTestRepoAt(t, dir)
+	if err := os.Rename(filepath.Join(dir, ".git"), filepath.Join(dir, ".repo")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_DIR", ".repo")
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/demo/info/refs?service=git-upload-pack", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "refs/heads/master") {
+		t.Errorf("master isn't advertised in %q", w.Body.String())
+	}
+}
+
+func TestForceHTTPSKeepsPrefix(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.Prefix = "/git-forge"
+	config.ForceHTTPS = true
+	config.Host = "example.com"
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/git-forge/demo/refs?page=2", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("got %d", w.Code)
+	}
+	if got, want := w.Header().Get("Location"), "https://example.com/git-forge/demo/refs?page=2"; got != want {
+		t.Errorf("got Location %q, want %q", got, want)
+	}
+}
+
+// newTestRepoBelowParent creates a git root holding a demo repository
+// inside another repository that has a secret.txt, so paths escaping the
+// git root find a repository
+func newTestRepoBelowParent(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	parent := t.TempDir()
+	r, err := git.PlainInit(parent, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestFiles(t, w, "Add a secret", time.Now(), map[string]string{"secret.txt": "secret"})
+
+	config := New()
+	config.Git.Root = filepath.Join(parent, "repos")
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "demo"))
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+func TestRepoPathTraversal(t *testing.T) {
+	router := newTestRepoBelowParent(t)
+
+	for _, url := range []string{
+		"/../archive/master.zip",
+		"/../raw/master/secret.txt",
+		"/../blame/master/secret.txt",
+		"/..",
+		"/../refs",
+		"/../log/master",
+		"/../tree/master/secret.txt",
+		"/../commit/master",
+		"/./tree/master/README",
+		"/git/../info/refs?service=git-upload-pack",
+		"/../info/refs?service=git-upload-pack",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", url, w.Code)
+		}
+	}
+}
+
+func TestTemplateExtensions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "404.tmpl"), []byte("custom not found"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Not loaded, its extension isn't listed
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("custom index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, templatesDir := range []string{"", dir} {
+		config := New()
+		config.Git.Root = t.TempDir()
+		config.Templates.Dir = templatesDir
+		config.Templates.Extensions = []string{".tmpl"}
+
+		if err := config.LoadAllRepositories(); err != nil {
+			t.Fatal(err)
+		}
+		router, err := NewRouter(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "custom index") {
+			t.Errorf("dir %q: index got %d, %q", templatesDir, w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/missing", nil)
+		router.ServeHTTP(w, req)
+		custom := strings.Contains(w.Body.String(), "custom not found")
+		if w.Code != http.StatusNotFound || custom != (templatesDir != "") {
+			t.Errorf("dir %q: 404 page got %d, %q", templatesDir, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestLoadConfigWithoutHost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repos")
+	newTestRepoAt(t, filepath.Join(root, "demo"))
+
+	path := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(path, []byte("force_https: true\ngit:\n  root: "+root+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "" {
+		t.Errorf("got host %q, want it left empty", config.Host)
+	}
+	if repo, _ := config.FindRepo("demo"); repo.CloneURL != "" {
+		t.Errorf("got clone URL %q without a host", repo.CloneURL)
+	}
+	if config.MaxRequestBodyBytes != New().MaxRequestBodyBytes {
+		t.Errorf("got max_request_body_bytes %d, want the default", config.MaxRequestBodyBytes)
+	}
+
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/demo", nil)
+	req.Host = "forge.example.com:8080"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	router.ServeHTTP(w, req)
+
+	if got, want := w.Header().Get("Location"), "https://forge.example.com:8080/demo"; got != want {
+		t.Errorf("got Location %q, want %q", got, want)
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.MaxRequestBodyBytes = 64
+
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "demo"))
+
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		tooLarge      bool
+	}{
+		{"declared length", strings.Repeat("0", 100), 100, true},
+		{"chunked", strings.Repeat("0", 100), -1, true},
+		{"chunked within the limit", "0000", -1, false},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/demo/git-upload-pack", strings.NewReader(test.body))
+		req.ContentLength = test.contentLength
+		router.ServeHTTP(w, req)
+
+		if got := w.Code == http.StatusRequestEntityTooLarge; got != test.tooLarge {
+			t.Errorf("%s: got %d, %q", test.name, w.Code, w.Body.String())
+		}
+		if test.tooLarge && !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%s: got %q, want a JSON error", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestCSPNonce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.CustomJS = "console.log('hi')"
+	if err := config.loadCustomJS(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		policy := w.Header().Get("Content-Security-Policy")
+		match := regexp.MustCompile(`'nonce-([A-Za-z0-9_-]+)'`).FindStringSubmatch(policy)
+		if match == nil {
+			t.Fatalf("no nonce in Content-Security-Policy %q", policy)
+		}
+		nonce := match[1]
+		nonces[nonce] = true
+
+		if want := `<script nonce="` + nonce + `">console.log('hi')</script>`; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the custom script doesn't carry the nonce %s", nonce)
+		}
+	}
+
+	if len(nonces) != 2 {
+		t.Error("two requests got the same nonce")
+	}
+}
+
+// configKeys lists the keys of a decoded YAML or JSON document by their
+// path, e.g. git.root
+func configKeys(prefix string, value interface{}, keys map[string]bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, v := range value {
+			keys[prefix+key] = true
+			configKeys(prefix+key+".", v, keys)
+		}
+	case map[interface{}]interface{}:
+		for key, v := range value {
+			name := fmt.Sprint(key)
+			keys[prefix+name] = true
+			configKeys(prefix+name+".", v, keys)
+		}
+	case []interface{}:
+		for _, v := range value {
+			configKeys(prefix, v, keys)
+		}
+	}
+}
+
+func TestResolvedConfigJSONKeys(t *testing.T) {
+	config := New()
+	config.Git.Root = t.TempDir()
+	config.Git.Repos = []RepoConfig{{Path: "demo", Title: "Demo"}}
+	config.Git.OperationTimeout = "5s"
+	newTestRepoAt(t, filepath.Join(config.Git.Root, "demo"))
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	resolved := config.Resolved()
+
+	out, err := yaml.Marshal(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromYAML interface{}
+	if err := yaml.Unmarshal(out, &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = json.Marshal(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON interface{}
+	if err := json.Unmarshal(out, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	yamlKeys, jsonKeys := map[string]bool{}, map[string]bool{}
+	configKeys("", fromYAML, yamlKeys)
+	configKeys("", fromJSON, jsonKeys)
+
+	for _, key := range []string{"title", "git.operation_timeout", "repos_by_slug", "repos_by_slug.demo.meta.title"} {
+		if !jsonKeys[key] {
+			t.Errorf("the JSON has no %s", key)
+		}
+	}
+	for key := range yamlKeys {
+		if !jsonKeys[key] {
+			t.Errorf("%s is in the YAML but not the JSON", key)
+		}
+	}
+}
+
+func TestCloneRepository(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "project.git")
+	hash := newTestRepoAt(t, remote)
+
+	config := New()
+	config.Git.Root = t.TempDir()
+	if err := config.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that doesn't watch the git root
+	holder := NewConfigHolder(config)
+	if err := WatchRepositories(holder); err != nil {
+		t.Fatal(err)
+	}
+
+	// smithy clone works on a configuration of its own
+	cli := config
+	if err := CloneRepository(&cli, "file://"+remote, "", true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, exists := cli.FindRepo("project")
+	if !exists {
+		t.Fatal("the clone isn't in the configuration")
+	}
+	head, err := repo.Repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != hash {
+		t.Errorf("the clone's HEAD is %s, want %s", head.Hash(), hash)
+	}
+
+	state, err := os.ReadFile(filepath.Join(config.Git.Root, CloneStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "project file://" + remote + "\n"; string(state) != want {
+		t.Errorf("got state %q, want %q", state, want)
+	}
+
+	if err := CloneRepository(&cli, "file://"+remote, "", true, nil); err == nil {
+		t.Error("cloned over an existing repository")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		config := holder.Get()
+		if _, exists := config.FindRepo("project"); exists {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("the running server didn't load the clone")
+}
+
+var (
+	splitRowRegexp  = regexp.MustCompile(`<tr>(.*)</tr>`)
+	splitHunkRegexp = regexp.MustCompile(`<td colspan="4" class="diff-hunk">(.*)</td>`)
+	splitCellRegexp = regexp.MustCompile(`<td class="diff-line-number">(\d*)</td><td class="diff-(\w+)">([^<]*)</td>`)
+)
+
+// splitRows summarizes the hunks SideBySideEncoder wrote as one line per row,
+// like "2-b | 2+X", leaving out the file header
+func splitRows(t *testing.T, table string) []string {
+	signs := map[string]string{"add": "+", "delete": "-", "equal": " ", "empty": ""}
+
+	var rows []string
+	for _, row := range splitRowRegexp.FindAllStringSubmatch(table, -1) {
+		if strings.Contains(row[1], "diff-header") {
+			continue
+		}
+		if hunk := splitHunkRegexp.FindStringSubmatch(row[1]); hunk != nil {
+			rows = append(rows, hunk[1])
+			continue
+		}
+
+		cells := splitCellRegexp.FindAllStringSubmatch(row[1], -1)
+		if len(cells) != 2 {
+			t.Fatalf("row %q doesn't have two sides", row[1])
+		}
+		var sides []string
+		for _, cell := range cells {
+			sides = append(sides, cell[1]+signs[cell[2]]+cell[3])
+		}
+		rows = append(rows, strings.Join(sides, " | "))
+	}
+	return rows
+}
+
+func TestSideBySideEncoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to map[string]string
+		header   string
+		rows     []string
+	}{
+		{
+			name:   "add only",
+			from:   map[string]string{"f": "a\nb\n"},
+			to:     map[string]string{"f": "a\nx\ny\nb\n"},
+			header: "--- a/f\n+++ b/f",
+			rows:   []string{"@@ -1,2 +1,4 @@", "1 a | 1 a", " | 2+x", " | 3+y", "2 b | 4 b"},
+		},
+		{
+			name:   "delete only",
+			from:   map[string]string{"f": "a\nx\ny\nb\n"},
+			to:     map[string]string{"f": "a\nb\n"},
+			header: "--- a/f\n+++ b/f",
+			rows:   []string{"@@ -1,4 +1,2 @@", "1 a | 1 a", "2-x | ", "3-y | ", "4 b | 2 b"},
+		},
+		{
+			name:   "more deleted than added",
+			from:   map[string]string{"f": "a\nb\nc\nd\n"},
+			to:     map[string]string{"f": "a\nX\nd\n"},
+			header: "--- a/f\n+++ b/f",
+			rows:   []string{"@@ -1,4 +1,3 @@", "1 a | 1 a", "2-b | 2+X", "3-c | ", "4 d | 3 d"},
+		},
+		{
+			name:   "more added than deleted",
+			from:   map[string]string{"f": "a\nb\nd\n"},
+			to:     map[string]string{"f": "a\nX\nY\nd\n"},
+			header: "--- a/f\n+++ b/f",
+			rows:   []string{"@@ -1,3 +1,4 @@", "1 a | 1 a", "2-b | 2+X", " | 3+Y", "3 d | 4 d"},
+		},
+		{
+			name:   "binary",
+			from:   map[string]string{"f": "a\x00b"},
+			to:     map[string]string{"f": "a\x00c"},
+			header: "Binary files a/f and b/f differ",
+		},
+		{
+			name:   "new file",
+			from:   map[string]string{},
+			to:     map[string]string{"f": "x\n<y>\n"},
+			header: "new file mode 100644",
+			rows:   []string{"@@ -0,0 +1,2 @@", " | 1+x", " | 2+&lt;y&gt;"},
+		},
+		{
+			name:   "deleted file",
+			from:   map[string]string{"f": "x\n", "g": "y\n"},
+			to:     map[string]string{"g": "y\n"},
+			header: "deleted file mode 100644",
+			rows:   []string{"@@ -1 +0,0 @@", "1-x | "},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sb strings.Builder
+			if err := NewSideBySideEncoder(&sb, DefaultContextLines).Encode(*newTestPatch(t, test.from, test.to)); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(sb.String(), test.header) {
+				t.Errorf("the header doesn't have %q:\n%s", test.header, sb.String())
+			}
+			if got := splitRows(t, sb.String()); !reflect.DeepEqual(got, test.rows) {
+				t.Errorf("got rows %q, want %q", got, test.rows)
+			}
+		})
+	}
+}
+
+func TestUnifiedEncoderWordDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		wordDiff bool
+		want     string
+	}{
+		{
+			name:     "changed word",
+			from:     "the quick fox\n",
+			to:       "the slow fox\n",
+			wordDiff: true,
+			want: "@@ -1 +1 @@\n" +
+				`<span class="diff-delete">-the <span class="diff-word-del">quick</span> fox</span>` + "\n" +
+				`<span class="diff-add">+the <span class="diff-word-add">slow</span> fox</span>` + "\n",
+		},
+		{
+			name:     "off",
+			from:     "the quick fox\n",
+			to:       "the slow fox\n",
+			wordDiff: false,
+			want: "@@ -1 +1 @@\n" +
+				`<span class="diff-delete">-the quick fox</span>` + "\n" +
+				`<span class="diff-add">+the slow fox</span>` + "\n",
+		},
+		{
+			name:     "add only",
+			from:     "a\n",
+			to:       "a\nb\n",
+			wordDiff: true,
+			want: "@@ -1 +1,2 @@\n" +
+				`<span class="diff-equal"> a</span>` + "\n" +
+				`<span class="diff-add">+b</span>` + "\n",
+		},
+		{
+			name:     "more deleted than added",
+			from:     "a\nold one\nold two\nd\n",
+			to:       "a\nnew one\nd\n",
+			wordDiff: true,
+			want: "@@ -1,4 +1,3 @@\n" +
+				`<span class="diff-equal"> a</span>` + "\n" +
+				`<span class="diff-delete">-<span class="diff-word-del">old</span> one</span>` + "\n" +
+				`<span class="diff-delete">-old two</span>` + "\n" +
+				`<span class="diff-add">+<span class="diff-word-add">new</span> one</span>` + "\n" +
+				`<span class="diff-equal"> d</span>` + "\n",
+		},
+		{
+			name:     "more added than deleted",
+			from:     "old one\n",
+			to:       "new one\nnew two\n",
+			wordDiff: true,
+			want: "@@ -1 +1,2 @@\n" +
+				`<span class="diff-delete">-<span class="diff-word-del">old</span> one</span>` + "\n" +
+				`<span class="diff-add">+<span class="diff-word-add">new</span> one</span>` + "\n" +
+				`<span class="diff-add">+new two</span>` + "\n",
+		},
+		{
+			name:     "escaped words",
+			from:     "x <b> y\n",
+			to:       "x <i> y\n",
+			wordDiff: true,
+			want: "@@ -1 +1 @@\n" +
+				`<span class="diff-delete">-x &lt;<span class="diff-word-del">b</span>&gt; y</span>` + "\n" +
+				`<span class="diff-add">+x &lt;<span class="diff-word-add">i</span>&gt; y</span>` + "\n",
+		},
+		{
+			name:     "binary",
+			from:     "a\x00b",
+			to:       "a\x00c",
+			wordDiff: true,
+			want:     "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch := newTestPatch(t, map[string]string{"f": test.from}, map[string]string{"f": test.to})
+
+			var sb strings.Builder
+			if err := NewUnifiedEncoder(&sb, DefaultContextLines).SetWordDiff(test.wordDiff).Encode(*patch); err != nil {
+				t.Fatal(err)
+			}
+
+			// Leave out the file header
+			got := ""
+			if i := strings.Index(sb.String(), "@@"); i >= 0 {
+				got = sb.String()[i:]
+			}
+			if got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeCSS(t *testing.T) {
+	for css, want := range map[string]string{
+		"body { color: red; }":              "body { color: red; }",
+		"</style><script>alert(1)</script>": `\3c /style>\3c script>alert(1)\3c /script>`,
+		"</STYLE >":                         `\3c /STYLE >`,
+		"<!-- a { content: '<' } -->":       `\3c !-- a { content: '\3c ' } -->`,
+		"a > b":                             "a > b",
+		"":                                  "",
+	} {
+		if got := SanitizeCSS(css); got != want {
+			t.Errorf("SanitizeCSS(%q) = %q, want %q", css, got, want)
+		}
+	}
+}
+
+func TestSanitizeJS(t *testing.T) {
+	for js, want := range map[string]string{
+		"console.log('hi')":               "console.log('hi')",
+		"var s = '</script><b>';":         `var s = '<\/script><b>';`,
+		"var s = '</SCRIPT >';":           `var s = '<\/SCRIPT >';`,
+		"var s = '<!--<script>';":         `var s = '<!--\x3Cscript>';`,
+		"var s = '<!--<ScRiPt ';":         `var s = '<!--\x3CScRiPt ';`,
+		"if (a < b && c </d/.test(e)) {}": `if (a < b && c <\/d/.test(e)) {}`,
+		"":                                "",
+	} {
+		if got := SanitizeJS(js); got != want {
+			t.Errorf("SanitizeJS(%q) = %q, want %q", js, got, want)
+		}
+	}
+}
+
+func TestLinkify(t *testing.T) {
+	link := func(regex, url, label string) LinkPattern {
+		return LinkPattern{Regex: regex, URL: url, Label: label, regex: regexp.MustCompile(regex)}
+	}
+	issue := link(`#(\d+)`, "https://bugs.example.com/$1", "Issue")
+
+	tests := []struct {
+		name     string
+		text     string
+		patterns []LinkPattern
+		want     string
+	}{
+		{
+			name: "no patterns",
+			text: "Fix <b>bold</b> & \"quotes\"",
+			want: "Fix &lt;b&gt;bold&lt;/b&gt; &amp; &#34;quotes&#34;",
+		},
+		{
+			name:     "html around matches",
+			text:     "<script>Fixes #12</script> and #3",
+			patterns: []LinkPattern{issue},
+			want: `&lt;script&gt;Fixes <a href="https://bugs.example.com/12" title="Issue">#12</a>&lt;/script&gt; and ` +
+				`<a href="https://bugs.example.com/3" title="Issue">#3</a>`,
+		},
+		{
+			name:     "html in matches",
+			text:     `see "a<b"`,
+			patterns: []LinkPattern{link(`see (\S+)`, "https://example.com/?q=$1", `"<x>"`)},
+			want:     `<a href="https://example.com/?q=&#34;a&lt;b&#34;" title="&#34;&lt;x&gt;&#34;">see &#34;a&lt;b&#34;</a>`,
+		},
+		{
+			name:     "earliest overlapping match wins",
+			text:     "ABC-123",
+			patterns: []LinkPattern{link(`\d+`, "https://example.com/n/$0", ""), link(`ABC-\d+`, "https://example.com/$0", "")},
+			want:     `<a href="https://example.com/ABC-123">ABC-123</a>`,
+		},
+		{
+			name:     "first pattern wins at the same start",
+			text:     "#12",
+			patterns: []LinkPattern{link(`#\d`, "https://example.com/first", ""), issue},
+			want:     `<a href="https://example.com/first">#1</a>2`,
+		},
+		{
+			name:     "empty matches",
+			text:     "a12b",
+			patterns: []LinkPattern{link(`x*`, "https://example.com/x", ""), link(`\d*`, "https://example.com/$0", "")},
+			want:     `a<a href="https://example.com/12">12</a>b`,
+		},
+		{
+			name:     "uncompiled pattern",
+			text:     "#12",
+			patterns: []LinkPattern{{Regex: `#(\d+)`, URL: "https://example.com/$1"}},
+			want:     "#12",
+		},
+	}
+
+	for _, test := range tests {
+		if got := string(Linkify(test.text, test.patterns)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPatchSize(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+
+	var commits []*object.Commit
+	for _, contents := range []string{strings.Join(lines, "\n"), strings.Replace(strings.Join(lines, "\n"), "line 500\n", "changed\n", 1)} {
+		hash := commitTestFiles(t, w, "Change big.txt", time.Now(), map[string]string{"big.txt": contents + "\n"})
+		commit, err := r.CommitObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, commit)
+	}
+
+	patch, err := commits[0].Patch(commits[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The removed and added lines and three lines on either side
+	want := len("line 500\n") + len("changed\n") + len("line 497\nline 498\nline 499\n") + len("line 501\nline 502\nline 503\n")
+	if got := patchSize(patch, 3); got != want {
+		t.Errorf("got %d bytes, want %d", got, want)
+	}
+}
+
+func TestCountLanguageLinesExclude(t *testing.T) {
+	commit := newTestCommit(t, map[string]string{
+		"main.go":            "package main\n\nfunc main() {}\n",
+		"vendor/lib/lib.go":  "package lib\n",
+		"static/app.min.js":  "var a;\n",
+		"static/app/main.js": "var b;\nvar c;\n",
+	})
+
+	lines, err := countLanguageLines(context.Background(), commit, []string{"vendor/**", "*.min.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"Go": 3, "JavaScript": 2}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %v, want %v", lines, want)
+	}
+}
+
+func TestExtractPGPKeyID(t *testing.T) {
+	entity, err := openpgp.NewEntity("Tester", "", "tester@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, entity, strings.NewReader("tree 0000\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExtractPGPKeyID(signature.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := fmt.Sprintf("%016X", entity.PrimaryKey.KeyId); got != want {
+		t.Errorf("got key ID %s, want %s", got, want)
+	}
+
+	if _, err := ExtractPGPKeyID("not a signature"); err == nil {
+		t.Error("got no error for a message that isn't armored")
+	}
+}
@@ -0,0 +1,78 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// removeStaleSocket removes the socket a previous run left behind at
+// socketPath.  Anything else there is left alone, so listening fails.
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", socketPath)
+	}
+	return os.Remove(socketPath)
+}
+
+// runUnixSocket serves handler on a Unix domain socket at socketPath until
+// smithy is interrupted or terminated, and then removes the socket
+func runUnixSocket(handler http.Handler, socketPath string) error {
+	if err := removeStaleSocket(socketPath); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	// Stop serving on signals so that the socket is cleaned up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		close(stopped)
+		listener.Close()
+	}()
+
+	err = http.Serve(listener, handler)
+
+	select {
+	case <-stopped:
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,242 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/gin-gonic/gin"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// OtherLanguage groups the lines of files no lexer recognizes
+const OtherLanguage = "Other"
+
+// LanguageStat is the number of lines written in a language
+type LanguageStat struct {
+	Language string
+	Lines    int
+
+	// Percent is the share of all lines, rounded down
+	Percent int
+}
+
+// RepoStats is an overview of a repository as of Head
+type RepoStats struct {
+	Head         plumbing.Hash
+	Commits      int
+	Contributors int
+	Branches     int
+	Tags         int
+	Lines        int
+
+	// Languages holds the lines per language in HEAD, most lines first
+	Languages []LanguageStat
+}
+
+// cachedRepoStats are the stats of a repository along with the exclude
+// patterns they were computed with
+type cachedRepoStats struct {
+	stats   RepoStats
+	exclude string
+}
+
+// statsCache maps repository names to their cachedRepoStats, which are
+// recomputed when HEAD moves or the exclude patterns change
+var statsCache sync.Map
+
+// countLanguageLines counts the lines of each text file in commit's tree by
+// language, as named by the lexer matching its extension.  Files matching
+// any of the exclude patterns aren't counted.
+func countLanguageLines(ctx context.Context, commit *object.Commit, exclude []string) (map[string]int, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := map[string]int{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if MatchesExcludePattern(f.Name, exclude) {
+			return ctx.Err()
+		}
+
+		binary, err := f.IsBinary()
+		if err != nil || binary {
+			return err
+		}
+
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		language := OtherLanguage
+		if lexer := lexers.Match(f.Name); lexer != nil {
+			language = lexer.Config().Name
+		}
+		lines[language] += countLines(contents)
+		return ctx.Err()
+	})
+
+	return lines, err
+}
+
+// ComputeRepoStats counts the commits, contributors, branches, tags and
+// lines of code of the repository called name, reusing the cached stats
+// while HEAD stays the same.  Files matching any of the exclude patterns
+// aren't counted as lines of code.  It gives up once ctx is done.
+func ComputeRepoStats(ctx context.Context, name string, r *git.Repository, exclude []string) (RepoStats, error) {
+	head, err := r.Head()
+	if err != nil {
+		return RepoStats{}, err
+	}
+
+	key := excludeKey(exclude)
+	if cached, ok := statsCache.Load(name); ok {
+		if c := cached.(cachedRepoStats); c.stats.Head == head.Hash() && c.exclude == key {
+			return c.stats, nil
+		}
+	}
+
+	return shareGitOperation(ctx, "stats:"+name+":"+head.Hash().String()+":"+key, func(ctx context.Context) (RepoStats, error) {
+		stats, err := computeRepoStats(ctx, r, head.Hash(), exclude)
+		if err != nil {
+			return stats, err
+		}
+
+		statsCache.Store(name, cachedRepoStats{stats: stats, exclude: key})
+		return stats, nil
+	})
+}
+
+// computeRepoStats computes the stats of r as of head
+func computeRepoStats(ctx context.Context, r *git.Repository, head plumbing.Hash, exclude []string) (RepoStats, error) {
+	stats := RepoStats{Head: head}
+
+	commit, err := r.CommitObject(head)
+	if err != nil {
+		return stats, err
+	}
+
+	missing, err := missingParents(r)
+	if err != nil {
+		return stats, err
+	}
+
+	authors := map[string]bool{}
+	cIter := object.NewCommitIterCTime(commit, missing, nil)
+	defer cIter.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		c, err := cIter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Commits++
+		authors[strings.ToLower(c.Author.Email)] = true
+	}
+	stats.Contributors = len(authors)
+
+	branches, err := ListBranches(r)
+	if err != nil {
+		return stats, err
+	}
+	stats.Branches = len(branches)
+
+	tags, err := ListTags(r)
+	if err != nil {
+		return stats, err
+	}
+	stats.Tags = len(tags)
+
+	lines, err := countLanguageLines(ctx, commit, exclude)
+	if err != nil {
+		return stats, err
+	}
+
+	for language, count := range lines {
+		stats.Lines += count
+		stats.Languages = append(stats.Languages, LanguageStat{Language: language, Lines: count})
+	}
+
+	for i := range stats.Languages {
+		if stats.Lines > 0 {
+			stats.Languages[i].Percent = stats.Languages[i].Lines * 100 / stats.Lines
+		}
+	}
+
+	sort.Slice(stats.Languages, func(i, j int) bool {
+		a, b := stats.Languages[i], stats.Languages[j]
+		if a.Lines != b.Lines {
+			return a.Lines > b.Lines
+		}
+		return a.Language < b.Language
+	})
+
+	return stats, nil
+}
+
+// StatsView shows an overview of a repository's history and languages
+func StatsView(ctx *gin.Context, urlParts []string) {
+	repoName := urlParts[0]
+	smithyConfig := ctx.MustGet("config").(SmithyConfig)
+
+	repo, exists := smithyConfig.FindRepo(repoName)
+
+	if !exists {
+		Http404(ctx)
+		return
+	}
+
+	var stats RepoStats
+
+	start := time.Now()
+	err := smithyConfig.WithGitTimeout(ctx.Request.Context(), func(ctx context.Context) error {
+		var err error
+		stats, err = ComputeRepoStats(ctx, repoName, repo.Repository, smithyConfig.Exclude.Patterns)
+		return err
+	})
+	ObserveGitOperation(GitOperationStats, repoName, time.Since(start))
+
+	if err != nil {
+		ctx.Error(err)
+		Http500(ctx)
+		return
+	}
+
+	RespondWith(ctx, "stats.html", makeTemplateContext(ctx, smithyConfig, gin.H{
+		"RepoName": repoName,
+		"Repo":     repo,
+		"Stats":    stats,
+	}))
+}
@@ -0,0 +1,138 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// SubmoduleEntry is a tree entry pointing at a commit in another repository
+type SubmoduleEntry struct {
+	Name      string
+	Hash      plumbing.Hash
+	ShortHash string
+
+	// URL is where the submodule is cloned from according to .gitmodules,
+	// empty when it isn't listed there
+	URL string
+
+	// WebURL is the page of the submodule's repository, only set when
+	// git.resolve_submodule_urls is
+	WebURL string
+}
+
+// SplitSubmodules separates the submodules of the directory dir of commit
+// from its other entries, looking up their URLs in .gitmodules
+func SplitSubmodules(commit *object.Commit, dir string, entries []TreeEntry, config GitConfig) ([]TreeEntry, []SubmoduleEntry) {
+	files := FilterTreeEntries(entries, func(entry TreeEntry) bool {
+		return !entry.IsSubmodule()
+	})
+	if len(files) == len(entries) {
+		return files, nil
+	}
+
+	urls := submoduleURLs(commit)
+
+	var submodules []SubmoduleEntry
+	for _, entry := range entries {
+		if !entry.IsSubmodule() {
+			continue
+		}
+
+		// The commit is in another repository, there's nothing to be
+		// ambiguous with
+		submodule := SubmoduleEntry{
+			Name:      entry.Name,
+			Hash:      entry.Hash,
+			ShortHash: SafeShortHash(nil, entry.Hash, config.ShortHashLength),
+			URL:       urls[path.Join(dir, entry.Name)],
+		}
+		if config.ResolveSubmoduleURLs {
+			submodule.WebURL = SubmoduleWebURL(submodule.URL)
+		}
+		submodules = append(submodules, submodule)
+	}
+
+	return files, submodules
+}
+
+// submoduleURLs maps the paths of the submodules listed in commit's
+// .gitmodules to their URLs
+func submoduleURLs(commit *object.Commit) map[string]string {
+	urls := map[string]string{}
+
+	f, err := commit.File(".gitmodules")
+	if err != nil {
+		return urls
+	}
+
+	contents, err := f.Contents()
+	if err != nil {
+		return urls
+	}
+
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(contents)); err != nil {
+		return urls
+	}
+
+	for _, submodule := range modules.Submodules {
+		urls[path.Clean(submodule.Path)] = submodule.URL
+	}
+
+	return urls
+}
+
+// SubmoduleWebURL turns the clone URL of a submodule into the address of
+// its web page, e.g. git@example.com:user/repo.git into
+// https://example.com/user/repo.  Relative and local URLs give an empty
+// string.
+func SubmoduleWebURL(cloneURL string) string {
+	// scp-like syntax, user@host:path
+	if !strings.Contains(cloneURL, "://") {
+		at := strings.Index(cloneURL, "@")
+		colon := strings.Index(cloneURL, ":")
+		if at < 0 || colon < at {
+			return ""
+		}
+		cloneURL = "ssh://" + cloneURL[:colon] + "/" + cloneURL[colon+1:]
+	}
+
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "ssh", "git", "git+ssh":
+		u.Scheme = "https"
+		u.User = nil
+		u.Host = u.Hostname()
+	default:
+		return ""
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, ".git")
+	return u.String()
+}
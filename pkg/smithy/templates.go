@@ -0,0 +1,119 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"html/template"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin/render"
+)
+
+// Template cache strategies
+const (
+	// Parse templates once when the server starts
+	TemplateCacheStartup = "startup"
+	// Parse templates for every request
+	TemplateCacheRequest = "request"
+	// Parse templates again once they are older than the configured TTL
+	TemplateCacheTTL = "ttl"
+)
+
+// CachingTemplateLoader hands out parsed templates to gin, reloading them
+// according to the configured cache strategy
+type CachingTemplateLoader struct {
+	config   SmithyConfig
+	strategy string
+	ttl      time.Duration
+
+	mutex      sync.Mutex
+	templates  *template.Template
+	lastLoaded time.Time
+}
+
+func NewCachingTemplateLoader(config SmithyConfig) (*CachingTemplateLoader, error) {
+	loader := &CachingTemplateLoader{
+		config:   config,
+		strategy: config.Templates.Cache,
+	}
+
+	switch loader.strategy {
+	case "":
+		loader.strategy = TemplateCacheStartup
+	case TemplateCacheStartup, TemplateCacheRequest:
+	case TemplateCacheTTL:
+		ttl, err := time.ParseDuration(config.Templates.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template ttl: %w", err)
+		}
+		loader.ttl = ttl
+	default:
+		return nil, fmt.Errorf("unknown template cache strategy %q", loader.strategy)
+	}
+
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+func (l *CachingTemplateLoader) load() error {
+	templates, err := loadTemplates(l.config)
+	if err != nil {
+		return err
+	}
+
+	l.templates = templates
+	l.lastLoaded = time.Now()
+	return nil
+}
+
+// Templates returns the current templates, reloading them first if they are
+// stale.  When reloading fails the previous templates are kept.
+func (l *CachingTemplateLoader) Templates() *template.Template {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stale := false
+
+	switch l.strategy {
+	case TemplateCacheRequest:
+		stale = true
+	case TemplateCacheTTL:
+		stale = time.Since(l.lastLoaded) >= l.ttl
+	}
+
+	if stale {
+		if err := l.load(); err != nil {
+			fmt.Println("Failed to reload templates:", err)
+		}
+	}
+
+	return l.templates
+}
+
+// Instance implements gin's render.HTMLRender
+func (l *CachingTemplateLoader) Instance(name string, data interface{}) render.Render {
+	return render.HTML{
+		Template: l.Templates(),
+		Name:     name,
+		Data:     data,
+	}
+}
@@ -0,0 +1,144 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+)
+
+// HTTPRedirectPort is where plain HTTP requests are redirected to HTTPS, and
+// Let's Encrypt's challenges are answered, while TLS is on
+const HTTPRedirectPort = "80"
+
+// hostname is config.Host without a port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL over HTTPS
+func httpsRedirectHandler(config SmithyConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostname(config.Host)
+		if host == "" {
+			host = hostname(r.Host)
+		}
+		if config.Port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(config.Port))
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPRedirect listens on HTTPRedirectPort of the interface smithy
+// binds to in the background.  HTTPS is still served when it can't, e.g.
+// without the privileges to bind port 80.
+func serveHTTPRedirect(config SmithyConfig, handler http.Handler) {
+	addr := net.JoinHostPort(config.ListenAddress, HTTPRedirectPort)
+
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Println("Not redirecting HTTP to HTTPS:", err)
+		}
+	}()
+}
+
+// runTLS serves router over HTTPS on addr, with the configured certificate
+// or one from Let's Encrypt
+func runTLS(router *gin.Engine, config SmithyConfig, addr string) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: router,
+	}
+
+	if config.TLS.AutoTLS {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hostname(config.Host)),
+			Cache:      autocert.DirCache(config.TLS.CacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+
+		// The manager answers the HTTP challenges Let's Encrypt sends to
+		// port 80 and redirects everything else
+		serveHTTPRedirect(config, manager.HTTPHandler(httpsRedirectHandler(config)))
+	} else {
+		serveHTTPRedirect(config, httpsRedirectHandler(config))
+	}
+
+	if config.TLS.HTTP2 {
+		if err := http2.ConfigureServer(server, nil); err != nil {
+			return err
+		}
+	} else {
+		disableHTTP2(server)
+	}
+
+	// The certificate comes from the TLS config with AutoTLS
+	return server.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile)
+}
+
+// disableHTTP2 stops server from offering HTTP/2, which net/http otherwise
+// does by default over TLS
+func disableHTTP2(server *http.Server) {
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+
+	if server.TLSConfig == nil {
+		return
+	}
+
+	protos := []string{}
+	for _, proto := range server.TLSConfig.NextProtos {
+		if proto != http2.NextProtoTLS {
+			protos = append(protos, proto)
+		}
+	}
+	server.TLSConfig.NextProtos = protos
+}
+
+// ServerPushMiddleware has the stylesheet pushed along with pages served
+// over HTTP/2, before the browser asks for it.  Only responses rendered
+// from templates push it, see pushStylesheet.
+func ServerPushMiddleware(config SmithyConfig) gin.HandlerFunc {
+	cssPath := config.Prefix + config.Static.Prefix + "style.css"
+
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method == http.MethodGet && ctx.Writer.Pusher() != nil {
+			ctx.Set("pushPath", cssPath)
+		}
+	}
+}
+
+// pushStylesheet pushes the stylesheet if ServerPushMiddleware asked for it
+func pushStylesheet(ctx *gin.Context) {
+	cssPath := ctx.GetString("pushPath")
+	if cssPath == "" {
+		return
+	}
+	// Browsers may have turned pushes off, the page is served either way
+	ctx.Writer.Pusher().Push(cssPath, nil)
+}
@@ -0,0 +1,101 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ValidateConfig checks the configuration at path for every problem
+// LoadConfig would stop at, and for the ones Validate looks for, and
+// returns all of them
+func ValidateConfig(path string) []error {
+	config, errs, err := parseConfig(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	return append(errs, config.Validate()...)
+}
+
+// Validate loads the configuration's repositories and checks for problems
+// LoadConfig lets through, such as repositories that can't be opened, and
+// returns all of them
+func (sc *SmithyConfig) Validate() []error {
+	var errs []error
+
+	checkDir := func(what, dir string) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", what, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: %s isn't a directory", what, dir))
+		}
+	}
+
+	checkFile := func(what, file string) {
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", what, err))
+		}
+	}
+
+	checkDir("git.root", sc.Git.Root)
+
+	if len(errs) == 0 {
+		if err := sc.LoadAllRepositories(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Configured repositories that fail to open are skipped when loading
+	for _, repo := range sc.Git.Repos {
+		if repo.Exclude {
+			continue
+		}
+
+		repoPath := repo.Path
+		if !filepath.IsAbs(repoPath) {
+			repoPath = filepath.Join(sc.Git.Root, repoPath)
+		}
+
+		if _, err := OpenRepositoryWithEnv(repoPath); err != nil {
+			errs = append(errs, fmt.Errorf("repo %s: %w", repoPath, err))
+		}
+	}
+
+	if sc.Templates.Dir != "" {
+		checkDir("templates.dir", strings.TrimSuffix(sc.Templates.Dir, "*"))
+	}
+
+	if sc.Static.Root != "" {
+		checkDir("static.root", sc.Static.Root)
+	}
+
+	if sc.UnixSocket == "" && (sc.Port < 1 || sc.Port > 65535) {
+		errs = append(errs, fmt.Errorf("port: %d is out of range, must be between 1 and 65535", sc.Port))
+	}
+
+	if sc.TLS.CertFile != "" {
+		checkFile("tls.cert_file", sc.TLS.CertFile)
+		checkFile("tls.key_file", sc.TLS.KeyFile)
+	}
+
+	return errs
+}
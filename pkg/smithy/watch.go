@@ -0,0 +1,189 @@
+// smithy --- the git forge
+// Copyright (C) 2020   Honza Pokorny <honza@pokorny.ca>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smithy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchSettleTime is how long the git root has to be quiet before new
+// repositories are looked for, so that they're complete by then
+const WatchSettleTime = time.Second
+
+// WatchRepositories keeps the repositories in holder's configuration in step
+// with its git root: new directories are loaded once they've settled, and
+// repositories that are removed are dropped straight away.  Namespace
+// directories one level down are watched as well.  When a reload moves the
+// git root, the new one is watched instead.
+//
+// Unless git.watch is set, only changes to the CloneStateFile are acted
+// on, so that repositories `smithy clone` adds are loaded by a running
+// server either way.
+func WatchRepositories(holder *ConfigHolder) error {
+	root := holder.Get().Git.Root
+	watcher, err := newRootWatcher(holder.Get())
+	if err != nil {
+		return err
+	}
+
+	changes := holder.Changes()
+
+	go func() {
+		defer func() {
+			watcher.Close()
+		}()
+
+		settled := time.NewTimer(WatchSettleTime)
+		settled.Stop()
+
+		for {
+			select {
+			case <-changes:
+				config := holder.Get()
+				if config.Git.Root == root {
+					continue
+				}
+
+				// The old root keeps being watched until the new one can be
+				rootWatcher, err := newRootWatcher(config)
+				if err != nil {
+					fmt.Println("Failed to watch", config.Git.Root, err)
+					continue
+				}
+
+				watcher.Close()
+				watcher, root = rootWatcher, config.Git.Root
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// smithy clone writes the state file once a clone is
+				// complete, there's nothing to wait for
+				if filepath.Base(event.Name) == CloneStateFile {
+					if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+						settled.Reset(0)
+					}
+					continue
+				}
+
+				if !holder.Get().Git.Watch {
+					continue
+				}
+
+				if event.Op&fsnotify.Create != 0 {
+					settled.Reset(WatchSettleTime)
+				}
+
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					evictRepositories(holder, event.Name)
+				}
+
+			case <-settled.C:
+				err := holder.Update(func(config SmithyConfig) (SmithyConfig, error) {
+					err := config.LoadAllRepositories()
+					return config, err
+				})
+				if err != nil {
+					fmt.Println("Failed to load new repositories:", err)
+					continue
+				}
+
+				if err := watchNamespaces(watcher, holder.Get()); err != nil {
+					fmt.Println("Failed to watch", root, err)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Println("Failed to watch", root, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// newRootWatcher watches the git root of config and its namespaces
+func newRootWatcher(config SmithyConfig) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watchNamespaces(watcher, config); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return watcher, nil
+}
+
+// watchNamespaces watches the git root and the directories in it that
+// aren't repositories, which may hold namespaced ones
+func watchNamespaces(watcher *fsnotify.Watcher, config SmithyConfig) error {
+	if err := watcher.Add(config.Git.Root); err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(config.Git.Root)
+	if err != nil {
+		return err
+	}
+
+	repoPaths := map[string]bool{}
+	for _, repo := range config.GetRepositories() {
+		repoPaths[repo.Path] = true
+	}
+
+	for _, dir := range dirs {
+		dirPath := filepath.Join(config.Git.Root, dir.Name())
+		if !dir.IsDir() || repoPaths[dirPath] {
+			continue
+		}
+
+		// Watching is best effort for namespaces
+		watcher.Add(dirPath)
+	}
+
+	return nil
+}
+
+// evictRepositories drops the repositories at removed, or below it when
+// a namespace was removed, from the configuration in holder
+func evictRepositories(holder *ConfigHolder, removed string) {
+	holder.Update(func(config SmithyConfig) (SmithyConfig, error) {
+		// Requests may be reading the old map, so it's copied rather than
+		// changed
+		repos := make(map[string]RepositoryWithName, len(config.Git.reposBySlug))
+		for slug, repo := range config.Git.reposBySlug {
+			if repo.Path != removed && filepath.Dir(repo.Path) != removed {
+				repos[slug] = repo
+			}
+		}
+
+		config.Git.reposBySlug = repos
+		return config, nil
+	})
+}